@@ -5,6 +5,24 @@ import { Types } from "mongoose";
 import User from "../models/users";
 import Metadata from "../models/metadata";
 import { v4 as uuidv4 } from 'uuid';
+import axios from "axios";
+
+const UPLOAD_SERVICE_URL = process.env.UPLOAD_SERVICE_URL || "http://localhost:3000";
+
+// Asks the upload service which chunks of a recipe the caller has neither
+// uploaded nor proven to hold, and which dedup domain the caller's chunks are
+// stored in. A recipe naming any missing chunk must be refused, otherwise
+// knowing a chunk's hash would be enough to download it. The domain is kept
+// with the recipe so the download service finds the chunks for anyone the
+// file is shared with.
+const checkRecipe = async (token: string, chunks: ChunkData[]): Promise<{ missing: string[]; domain: string }> => {
+  const response = await axios.post<{ missing: string[]; domain: string }>(
+    `${UPLOAD_SERVICE_URL}/recipes/check`,
+    { shas: chunks.map((c) => c.sha) },
+    { headers: { Authorization: `Bearer ${token}` } }
+  );
+  return { missing: response.data.missing ?? [], domain: response.data.domain ?? "" };
+};
 
 // GET /api/files/by-ids
 export const getFilesByIds = async (req: Request, res: Response) => {
@@ -171,8 +189,22 @@ export const uploadFile = async (req: Request, res: Response) => {
     return;
   }
 
+  let domain: string;
+  try {
+    const check = await checkRecipe(req.cookies.token, chunks);
+    if (check.missing.length) {
+      res.status(403).json({ message: "Recipe names chunks that were not uploaded or proven", missing: check.missing });
+      return;
+    }
+    domain = check.domain;
+  } catch (err) {
+    console.error("Error checking recipe with the upload service:", err);
+    res.status(502).json({ message: "Could not check the recipe" });
+    return;
+  }
+
   try {
-    const metadataDoc = await Metadata.create({ chunks });
+    const metadataDoc = await Metadata.create({ chunks, domain });
 
     let fileDoc = await File.findOne({ user: user_id, file_name });
 
@@ -387,6 +419,12 @@ export const deleteFileById = async (req: Request, res: Response) => {
        return;
     }
 
+    // The recipes go too; chunks no other file uses are reclaimed by the
+    // upload service's GC after its grace period
+    await Metadata.deleteMany({
+      _id: { $in: deletedFile.metadata.map((m) => m._id) },
+    });
+
      res.status(200).json({ message: "File deleted successfully" });
      return;
   } catch (error) {
@@ -5,6 +5,9 @@ import { ChunkData } from '@neurostore/shared/types';
 
 export interface MetadataDocument extends Document {
   chunks: ChunkData[];
+  // Dedup domain the chunks are stored in, as reported by the upload service.
+  // "" is the global domain; recipes from before it was recorded have none.
+  domain?: string;
 }
 
 const chunkSchema = new Schema<ChunkData>(
@@ -19,6 +22,7 @@ const chunkSchema = new Schema<ChunkData>(
 
 const metadataSchema = new Schema<MetadataDocument>({
   chunks: [chunkSchema],
+  domain: { type: String },
 });
 
 export default mongoose.model<MetadataDocument>("Metadata", metadataSchema);
\ No newline at end of file
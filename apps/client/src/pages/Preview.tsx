@@ -8,7 +8,7 @@ import { FileDataDTO, ChunkData } from "@neurostore/shared/types";
 type Wrapper = {
   chunk_no: number;
   data: string; // base64 encoded
-  err?: string | null;
+  error?: string;
 };
 
 function getIframeMimeType(ext: string): string {
@@ -57,21 +57,13 @@ const Preview: React.FC = () => {
         const socket = new WebSocket("ws://localhost:3001/ws-getfile");
 
         socket.onopen = () => {
-          console.log("🔌 WebSocket connected, sending chunks...");
+          console.log("🔌 WebSocket connected, requesting file...");
           socket.send(
             JSON.stringify({
-              type: "chunk",
-              data: data.chunks,
+              type: "file",
+              file_id: fileId,
             })
           );
-
-          socket.send(
-            JSON.stringify({
-              type: "end",
-              data: [],
-            })
-          );
-          console.log("finsished sending metadata");
         };
 
         socket.onmessage = (event) => {
@@ -79,11 +71,8 @@ const Preview: React.FC = () => {
             const receivedData: Wrapper = JSON.parse(event.data);
             receivedChunks.push(receivedData); // ✅ store it
 
-            if (receivedData.err) {
-              console.error(
-                `❌ Error in chunk ${receivedData.chunk_no}:`,
-                receivedData.err
-              );
+            if (receivedData.error) {
+              console.error("❌ Download failed:", receivedData.error);
             } else {
               console.log(
                 `✅ Chunk ${receivedData.chunk_no} received successfully.`
@@ -99,11 +88,10 @@ const Preview: React.FC = () => {
         };
 
         socket.onclose = () => {
-          const sortedChunks = receivedChunks
-            .filter((chunk) => !chunk.err)
-            .sort((a, b) => a.chunk_no - b.chunk_no);
+          // Chunks arrive in file order; a failed download ends with an error frame
+          if (receivedChunks.some((chunk) => chunk.error)) return;
 
-          const byteArrays = sortedChunks.map((chunk) => {
+          const byteArrays = receivedChunks.map((chunk) => {
             const binaryString = atob(chunk.data);
             const byteArray = new Uint8Array(binaryString.length);
             for (let i = 0; i < binaryString.length; i++) {
@@ -80,6 +80,55 @@ const response = await axios.get(`${BASE_URL}/api/file/filename/${safeFilename}/
   };
 }
 
+ // Binary chunk frame, see services/upload-service/frame.go for the layout
+ const CHUNK_FRAME_PROTOCOL = "neurostore.chunks.v1";
+
+ function buildChunkFrame(chunkNo: number, sha: string, data: Uint8Array): ArrayBuffer {
+  const frame = new Uint8Array(41 + data.length);
+  const view = new DataView(frame.buffer);
+  frame[0] = 1;
+  view.setUint32(1, chunkNo);
+  for (let i = 0; i < 32; i++) {
+    frame[5 + i] = parseInt(sha.substr(i * 2, 2), 16);
+  }
+  view.setUint32(37, data.length);
+  frame.set(data, 41);
+  return frame.buffer;
+}
+
+ // Ownership challenge for a chunk the server already has, see
+ // services/upload-service/ownership.go
+ type OwnershipChallenge = { sha: string; nonce: string; ranges: [number, number][] };
+
+ const toHex = (bytes: Uint8Array) => [...bytes].map(b => b.toString(16).padStart(2, "0")).join("");
+
+ async function proveOwnership(challenges: OwnershipChallenge[], chunks: ChunkData[], file: File) {
+  const bySha = new Map(chunks.map(c => [c.sha, c]));
+  const proofs: { sha: string; proof: string }[] = [];
+
+  for (const challenge of challenges) {
+    const block = bySha.get(challenge.sha);
+    if (!block) continue;
+    const data = new Uint8Array(await file.slice(block.start, block.end + 1).arrayBuffer());
+
+    const nonce = new Uint8Array(challenge.nonce.length / 2);
+    for (let i = 0; i < nonce.length; i++) {
+      nonce[i] = parseInt(challenge.nonce.substr(i * 2, 2), 16);
+    }
+    const parts = [nonce, ...challenge.ranges.map(([start, end]) => data.subarray(start, end))];
+    const input = new Uint8Array(parts.reduce((n, p) => n + p.length, 0));
+    let offset = 0;
+    for (const part of parts) {
+      input.set(part, offset);
+      offset += part.length;
+    }
+
+    const digest = await crypto.subtle.digest("SHA-256", input);
+    proofs.push({ sha: challenge.sha, proof: toHex(new Uint8Array(digest)) });
+  }
+  return proofs;
+}
+
  function finddiff(arr1: ChunkData[], arr2: ChunkData[]): ChunkData[] {
   if(arr2.length==0)return arr1
   const shaSet = new Set(arr2.map(chunk => chunk.sha));
@@ -130,16 +179,8 @@ const Upload: React.FC = () => {
         console.log("unfortunatlety there is no update in the file")
         return
       }
-       const success = await uploadFileToServer(file, chunks);
-
-  if (success) {
-    console.log(" Upload completed and logged successfully");
-  } else {
-    console.error("Upload failed");
-  } 
-
-
- const ws = new WebSocket("ws://localhost:3000/ws/upload");
+ const ws = new WebSocket("ws://localhost:3000/ws/upload", [CHUNK_FRAME_PROTOCOL]);
+  ws.binaryType = "arraybuffer";
   
   let totalSentBytes = 0;
 
@@ -148,9 +189,33 @@ const Upload: React.FC = () => {
     ws.onerror = reject;
   });
 
+  // Ask which chunks the server is missing so shared chunks are never sent.
+  // Chunks it already has must be proven by answering its challenges.
+  const needed = await new Promise<Set<string>>((resolve) => {
+    const need = new Set<string>();
+    ws.onmessage = async (event) => {
+      const msg = JSON.parse(event.data);
+      if (msg.type !== "need") {
+        // Server without have-list support, send everything
+        resolve(new Set(chunks.map(c => c.sha)));
+        return;
+      }
+      (msg.shas ?? []).forEach((sha: string) => need.add(sha));
+      if (msg.challenges?.length) {
+        const proofs = await proveOwnership(msg.challenges, chunks, file);
+        ws.send(JSON.stringify({ type: "proof", proofs }));
+        return;
+      }
+      resolve(need);
+    };
+    ws.send(JSON.stringify({ type: "have", shas: chunks.map(c => c.sha) }));
+  });
+  ws.onmessage = (event) => console.error("Upload error from server:", event.data);
+
   for (let i = 0; i < chunks.length; i++) {
     const block = chunks[i];
     const { sha, start, end } = block;
+    if (!needed.has(sha)) continue;
 
     const slice = file.slice(start, end + 1); 
     const buffer = await slice.arrayBuffer();
@@ -158,6 +223,12 @@ const Upload: React.FC = () => {
     totalSentBytes += view.length;
 
     
+    // Older servers do not offer binary frames, fall back to base64 JSON
+    if (ws.protocol === CHUNK_FRAME_PROTOCOL) {
+      ws.send(buildChunkFrame(i + 1, sha, view));
+      continue;
+    }
+
     const base64 = btoa([...view].map(b => String.fromCharCode(b)).join(""));
 
     const message = JSON.stringify({
@@ -172,9 +243,6 @@ const Upload: React.FC = () => {
 
   console.log(` Total bytes read and sent: ${totalSentBytes}`);
   console.log(` Original file size: ${file.size}`);
-  if (totalSentBytes !== file.size) {
-    console.error(" MISMATCH in file size vs total bytes sent!");
-  }
 
   ws.send("__EOF__");
 
@@ -184,6 +252,16 @@ const Upload: React.FC = () => {
       resolve();
     };
   });
+
+  // The backend only registers a recipe whose chunks were uploaded or proven
+  // on the connection above
+  const success = await uploadFileToServer(file, chunks);
+
+  if (success) {
+    console.log(" Upload completed and logged successfully");
+  } else {
+    console.error("Upload failed");
+  } 
 };
 
   const handleFile = async (e: ChangeEvent<HTMLInputElement>) => {
@@ -239,29 +317,6 @@ const Upload: React.FC = () => {
   };
 
   
-const sendToBackend = async () => {
-  try {
-    const response = await fetch("http://localhost:3001/getfile", {
-      method: "POST",
-      headers: {
-        "Content-Type": "application/json"
-      },
-      body: JSON.stringify(blocks)
-    });
-
-    if (!response.ok) {
-      throw new Error(`Server error: ${response.status}`);
-    }
-
-    const result = await response.json();
-    console.log("📤 Sent blocks to backend. Response:", result);
-  } catch (err) {
-    console.error("❌ Failed to send to backend:", err);
-  }
-};
-
-
-
   return (
     <div className="p-4 font-mono">
       <h1 className="text-2xl font-bold mb-4">📦 WASM Chunker (WebSocket)</h1>
@@ -281,13 +336,6 @@ const sendToBackend = async () => {
             📄 <strong>{filename}</strong> ({extension}) — {Math.round(fileSize / 1024)} KB
           </p>
 
-          <button
-            onClick={sendToBackend}
-            className="px-4 py-2 bg-green-600 text-white rounded hover:bg-green-700 mb-2"
-          >
-            🚀 Send JSON to Backend
-          </button>
-
           {blocks.map((b, i) => (
             <div key={i} className="p-2 border rounded bg-gray-100">
               <strong>Chunk #{b.chunk_no}</strong><br />
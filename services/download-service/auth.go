@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Downloads are only served to callers holding a JWT issued by the backend.
+// The token is read from the "token" cookie the backend sets at login, or
+// from an "Authorization: Bearer" header for clients that are not browsers,
+// and is checked before the websocket upgrade so an unauthorized client
+// never gets a connection.
+//
+// Tokens are verified with JWT_SECRET, the HS256 key the backend signs with,
+// or with the public keys in JWT_JWKS_FILE (RS256 or ES256, picked by kid).
+// The user is the "id" claim the backend issues, or "sub"; the organisation
+// is the optional "org" claim. Tokens must carry an expiry.
+//
+// Without either setting the service refuses to start. For development,
+// AUTH_DISABLED=1 opens the endpoints instead and takes the caller's identity
+// from the X-User-ID and X-Org-ID headers, which anyone can set.
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	UserID string
+	OrgID  string
+}
+
+var ErrUnauthorized = errors.New("invalid token")
+
+// ErrNoToken is returned for requests without a token; they may still fetch
+// public files
+var ErrNoToken = errors.New("missing token")
+
+var (
+	jwtKeyfunc     jwt.Keyfunc
+	jwtMethods     []string
+	authDisabled   bool
+	allowedOrigins = map[string]bool{"http://localhost:5173": true}
+)
+
+// InitAuth reads JWT_SECRET or JWT_JWKS_FILE, or AUTH_DISABLED, and
+// ALLOWED_ORIGINS, the comma separated origins browsers may open websockets
+// from
+func InitAuth() {
+	secret := os.Getenv("JWT_SECRET")
+	jwksFile := os.Getenv("JWT_JWKS_FILE")
+	disabled := os.Getenv("AUTH_DISABLED") == "1"
+
+	switch {
+	case secret != "" && jwksFile != "":
+		log.Fatal("Set only one of JWT_SECRET and JWT_JWKS_FILE")
+	case disabled && (secret != "" || jwksFile != ""):
+		log.Fatal("AUTH_DISABLED=1 cannot be combined with JWT_SECRET or JWT_JWKS_FILE")
+	case secret != "":
+		key := []byte(secret)
+		jwtKeyfunc = func(*jwt.Token) (interface{}, error) { return key, nil }
+		jwtMethods = []string{"HS256"}
+		log.Println("Authenticating downloads with JWT_SECRET")
+	case jwksFile != "":
+		keys, err := loadJWKS(jwksFile)
+		if err != nil {
+			log.Fatalf("Failed to load JWT_JWKS_FILE: %v", err)
+		}
+		jwtKeyfunc = func(t *jwt.Token) (interface{}, error) {
+			kid, _ := t.Header["kid"].(string)
+			key, ok := keys[kid]
+			if !ok {
+				return nil, fmt.Errorf("unknown key id %q", kid)
+			}
+			return key, nil
+		}
+		jwtMethods = []string{"RS256", "ES256"}
+		log.Printf("Authenticating downloads with %d keys from %s", len(keys), jwksFile)
+	case disabled:
+		authDisabled = true
+		log.Println("WARNING: AUTH_DISABLED=1, downloads are not authenticated and callers are trusted to name themselves in X-User-ID and X-Org-ID. Never run like this outside development")
+	default:
+		log.Fatal("Set JWT_SECRET or JWT_JWKS_FILE to authenticate downloads, or AUTH_DISABLED=1 for development")
+	}
+
+	if v := os.Getenv("ALLOWED_ORIGINS"); v != "" {
+		allowedOrigins = make(map[string]bool)
+		for _, origin := range strings.Split(v, ",") {
+			allowedOrigins[strings.TrimSpace(origin)] = true
+		}
+	}
+}
+
+// authenticate returns the caller of a request
+func authenticate(r *http.Request) (Principal, error) {
+	if authDisabled {
+		return Principal{UserID: r.Header.Get("X-User-ID"), OrgID: r.Header.Get("X-Org-ID")}, nil
+	}
+	if jwtKeyfunc == nil {
+		return Principal{}, ErrUnauthorized
+	}
+
+	raw, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		cookie, err := r.Cookie("token")
+		if err != nil {
+			return Principal{}, ErrNoToken
+		}
+		raw = cookie.Value
+	}
+
+	var claims struct {
+		ID  string `json:"id"`
+		Org string `json:"org"`
+		jwt.RegisteredClaims
+	}
+	_, err := jwt.ParseWithClaims(raw, &claims, jwtKeyfunc,
+		jwt.WithValidMethods(jwtMethods), jwt.WithExpirationRequired())
+	if err != nil {
+		log.Printf("Rejected token: %v", err)
+		return Principal{}, ErrUnauthorized
+	}
+
+	p := Principal{UserID: claims.ID, OrgID: claims.Org}
+	if p.UserID == "" {
+		p.UserID = claims.Subject
+	}
+	if p.UserID == "" {
+		return Principal{}, ErrUnauthorized
+	}
+	return p, nil
+}
+
+// checkOrigin lets browsers open websockets from ALLOWED_ORIGINS only.
+// Requests without an Origin header do not come from a browser.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	return origin == "" || allowedOrigins["*"] || allowedOrigins[origin]
+}
+
+// loadJWKS reads the RSA and P-256 public keys of a JWKS file by kid
+func loadJWKS(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]interface{})
+	for _, k := range set.Keys {
+		switch k.Kty {
+		case "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err := errors.Join(err1, err2); err != nil {
+				return nil, fmt.Errorf("key %q: %v", k.Kid, err)
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			if k.Crv != "P-256" {
+				return nil, fmt.Errorf("key %q: unsupported curve %q", k.Kid, k.Crv)
+			}
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+			if err := errors.Join(err1, err2); err != nil {
+				return nil, fmt.Errorf("key %q: %v", k.Kid, err)
+			}
+			key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if !key.Curve.IsOnCurve(key.X, key.Y) {
+				return nil, fmt.Errorf("key %q is not on P-256", k.Kid)
+			}
+			keys[k.Kid] = key
+		default:
+			return nil, fmt.Errorf("key %q: unsupported key type %q", k.Kid, k.Kty)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no keys")
+	}
+	return keys, nil
+}
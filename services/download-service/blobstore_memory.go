@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryBlobStore keeps objects in a map. Nothing is persisted, so it is only
+// useful for tests and throwaway local runs.
+type MemoryBlobStore struct {
+	lock     sync.RWMutex
+	objects  map[string][]byte
+	modified map[string]time.Time
+}
+
+func NewMemoryBlobStore() *MemoryBlobStore {
+	return &MemoryBlobStore{objects: make(map[string][]byte), modified: make(map[string]time.Time)}
+}
+
+func (s *MemoryBlobStore) Put(ctx context.Context, key string, body io.Reader) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("failed to read blob body for %s: %v", key, err)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.objects[key] = data
+	s.modified[key] = time.Now()
+	return nil
+}
+
+func (s *MemoryBlobStore) GetRange(ctx context.Context, key string, start, end int64) ([]byte, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	data, ok := s.objects[key]
+	if !ok {
+		return nil, ErrBlobNotFound
+	}
+	if start < 0 || end < start || start >= int64(len(data)) {
+		return nil, fmt.Errorf("invalid range %d-%d for %s", start, end, key)
+	}
+	if end >= int64(len(data)) {
+		end = int64(len(data)) - 1
+	}
+
+	out := make([]byte, end-start+1)
+	copy(out, data[start:end+1])
+	return out, nil
+}
+
+func (s *MemoryBlobStore) Head(ctx context.Context, key string) (BlobInfo, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	data, ok := s.objects[key]
+	if !ok {
+		return BlobInfo{}, ErrBlobNotFound
+	}
+	sum := sha256.Sum256(data)
+	return BlobInfo{Key: key, Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:]), Modified: s.modified[key]}, nil
+}
+
+func (s *MemoryBlobStore) Delete(ctx context.Context, key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.objects, key)
+	delete(s.modified, key)
+	return nil
+}
+
+func (s *MemoryBlobStore) List(ctx context.Context, prefix string) ([]BlobInfo, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var result []BlobInfo
+	for key, data := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			result = append(result, BlobInfo{Key: key, Size: int64(len(data)), Modified: s.modified[key]})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key < result[j].Key
+	})
+	return result, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+)
+
+// ChunkIndex maps a chunk SHA to the pack and byte range holding its data.
+// Get skips shas that are not in the index. The upload service owns the
+// index; the download service only reads it.
+//
+// Outside the global dedup domain the "shas" are chunk keys, the SHA
+// prefixed with its domain (see chunkKey).
+type ChunkIndex interface {
+	Get(ctx context.Context, shas []string) (map[string]ChunkMeta, error)
+}
+
+var Index ChunkIndex
+
+// InitChunkIndex picks the backend from CHUNK_INDEX (redis or memory). The
+// memory index is read from CHUNK_INDEX_FILE, the snapshot the upload service
+// writes, which is enough for a single node deployment without Redis.
+func InitChunkIndex() {
+	backend := os.Getenv("CHUNK_INDEX")
+
+	switch backend {
+	case "", "redis":
+		InitRedis()
+		Index = NewRedisChunkIndex(RedisClient)
+	case "memory":
+		path := os.Getenv("CHUNK_INDEX_FILE")
+		idx, err := NewMemoryChunkIndex(path)
+		if err != nil {
+			log.Fatalf("Failed to load chunk index: %v", err)
+		}
+		Index = idx
+		if path == "" {
+			log.Println("Using in-memory chunk index, metadata will not survive a restart")
+		} else {
+			log.Printf("Reading embedded chunk index from %s", path)
+		}
+	default:
+		log.Fatalf("Unknown CHUNK_INDEX %q (expected redis or memory)", backend)
+	}
+}
+
+// chunkKey is the index key of a chunk in a dedup domain: the bare SHA in the
+// global domain, "<domain>/<sha>" in any other
+func chunkKey(domain, sha string) string {
+	if domain == "" {
+		return sha
+	}
+	return domain + "/" + sha
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// MemoryChunkIndex reads the embedded index the upload service keeps. With a
+// path set, it picks up the upload service's writes to the snapshot on its
+// next read.
+type MemoryChunkIndex struct {
+	lock    sync.RWMutex
+	metas   map[string]ChunkMeta
+	path    string
+	modTime time.Time
+}
+
+func NewMemoryChunkIndex(path string) (*MemoryChunkIndex, error) {
+	idx := &MemoryChunkIndex{metas: make(map[string]ChunkMeta), path: path}
+	if path == "" {
+		return idx, nil
+	}
+	if err := idx.reload(); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// reload reads the snapshot if it changed since we last looked. Callers must
+// hold the write lock.
+func (m *MemoryChunkIndex) reload() error {
+	if m.path == "" {
+		return nil
+	}
+
+	st, err := os.Stat(m.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if st.ModTime().Equal(m.modTime) {
+		return nil
+	}
+
+	data, err := os.ReadFile(m.path)
+	if err != nil {
+		return err
+	}
+	metas := make(map[string]ChunkMeta)
+	if err := json.Unmarshal(data, &metas); err != nil {
+		return fmt.Errorf("failed to parse chunk index %s: %v", m.path, err)
+	}
+
+	m.metas = metas
+	m.modTime = st.ModTime()
+	return nil
+}
+
+func (m *MemoryChunkIndex) Get(ctx context.Context, shas []string) (map[string]ChunkMeta, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err := m.reload(); err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]ChunkMeta, len(shas))
+	for _, sha := range shas {
+		if meta, ok := m.metas[sha]; ok {
+			result[sha] = meta
+		}
+	}
+	return result, nil
+}
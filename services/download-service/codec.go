@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// The upload service compresses and then encrypts chunks one by one (see
+// ChunkMeta.Codec and ChunkMeta.KeyID), so every chunk is decoded on its own
+// after it is fetched.
+
+// maxDecodedChunk caps what a single chunk may decode to
+const maxDecodedChunk = 64 << 20
+
+var zstdDecoder *zstd.Decoder
+
+func init() {
+	var err error
+	zstdDecoder, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(maxDecodedChunk))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// contentSize is the length of a chunk once decoded. Chunks packed before
+// compression existed have no Size and are stored as they are.
+func contentSize(meta ChunkMeta) int {
+	if meta.Size > 0 {
+		return meta.Size
+	}
+	return meta.End - meta.Start + 1
+}
+
+// decodeChunk turns the stored bytes of a chunk back into its content,
+// decrypting it first if it is encrypted
+func decodeChunk(meta ChunkMeta, stored []byte) ([]byte, error) {
+	stored, err := openChunk(meta, stored)
+	if err != nil {
+		return nil, err
+	}
+	var out []byte
+
+	switch meta.Codec {
+	case "":
+		out = stored
+	case "zstd":
+		out, err = zstdDecoder.DecodeAll(stored, make([]byte, 0, meta.Size))
+	case "gzip":
+		var zr *gzip.Reader
+		zr, err = gzip.NewReader(bytes.NewReader(stored))
+		if err == nil {
+			out, err = io.ReadAll(io.LimitReader(zr, maxDecodedChunk))
+		}
+	default:
+		return nil, fmt.Errorf("unknown codec %q", meta.Codec)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s chunk: %v", meta.Codec, err)
+	}
+	if meta.Size > 0 && len(out) != meta.Size {
+		return nil, fmt.Errorf("%s chunk decoded to %d bytes, expected %d", meta.Codec, len(out), meta.Size)
+	}
+	return out, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+)
+
+// Dedup domains are chosen by the upload service (see domain.go there); with
+// DEDUP_DOMAIN=org or user every organisation or user has its own index
+// namespace. The backend records the domain of each recipe, and downloads
+// look chunks up in that domain (see fileDomain). DEDUP_DOMAIN must match the
+// upload service; it only matters for recipes recorded without a domain.
+const (
+	DomainGlobal = "global"
+	DomainOrg    = "org"
+	DomainUser   = "user"
+)
+
+var dedupDomainMode = DomainGlobal
+
+var domainIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// InitDedupDomain reads DEDUP_DOMAIN (global, org or user)
+func InitDedupDomain() {
+	switch v := os.Getenv("DEDUP_DOMAIN"); v {
+	case "", DomainGlobal:
+		dedupDomainMode = DomainGlobal
+	case DomainOrg, DomainUser:
+		dedupDomainMode = v
+		log.Printf("Looking up chunks per %s", v)
+	default:
+		log.Fatalf("Invalid DEDUP_DOMAIN %q (expected global, org or user)", v)
+	}
+}
+
+// principalDomain returns the dedup domain of a caller, "" for the global one
+func principalDomain(p Principal) (string, error) {
+	var id string
+	switch dedupDomainMode {
+	case DomainOrg:
+		id = p.OrgID
+	case DomainUser:
+		id = p.UserID
+	default:
+		return "", nil
+	}
+
+	if !domainIDPattern.MatchString(id) {
+		return "", fmt.Errorf("missing or invalid %s id", dedupDomainMode)
+	}
+	return dedupDomainMode + "-" + id, nil
+}
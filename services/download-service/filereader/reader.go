@@ -0,0 +1,279 @@
+// Package filereader reads a stored file like a local one, for code that
+// needs random access rather than a stream: the central directory at the end
+// of a zip, the trailer of a PDF. A read fetches the chunks it covers, merging
+// chunks stored back to back in one pack into a single range read, and keeps
+// them decoded in a small LRU cache so reading around the same place costs no
+// further reads.
+//
+// The reader knows nothing about where recipes, chunk metadata or packs live;
+// it is handed a Recipe, an Index and a BlobStore.
+package filereader
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Recipe is a stored file: the SHAs of its chunks in file order
+type Recipe interface {
+	ChunkSHAs() []string
+}
+
+// Index says where chunks are stored. Locate skips SHAs it does not know.
+type Index interface {
+	Locate(ctx context.Context, shas []string) (map[string]Chunk, error)
+}
+
+// BlobStore reads packs. GetRange uses an inclusive end offset.
+type BlobStore interface {
+	GetRange(ctx context.Context, key string, start, end int64) ([]byte, error)
+}
+
+// Chunk is where a chunk is stored: the inclusive range [Start, End] of a
+// pack. Size is its length once decoded. Decode turns the stored bytes into
+// the chunk's content; nil means the chunk is stored as it is.
+type Chunk struct {
+	Pack   string
+	Start  int64
+	End    int64
+	Size   int
+	Decode func(stored []byte) ([]byte, error)
+}
+
+// ErrMissingChunk is returned by Open when the index lacks a chunk of the
+// recipe
+var ErrMissingChunk = errors.New("chunk missing from the index")
+
+// CacheSize is how many decoded chunks a Reader keeps. Chunks are at most
+// 16 KiB, so this is at most 1 MiB per reader.
+const CacheSize = 64
+
+// maxFetches bounds the range reads one read runs at once
+const maxFetches = 4
+
+// Reader implements io.ReaderAt and io.ReadSeeker over a stored file
+type Reader struct {
+	ctx     context.Context
+	blobs   BlobStore
+	chunks  []Chunk
+	offsets []int64
+	size    int64
+
+	lock  sync.Mutex
+	pos   int64
+	cache map[int]*list.Element
+	lru   *list.List // of *cachedChunk, most recently used first
+}
+
+type cachedChunk struct {
+	i    int
+	data []byte
+}
+
+// Open looks up the chunks of a recipe and returns a reader over the file.
+// ctx bounds every fetch the reader makes.
+func Open(ctx context.Context, recipe Recipe, index Index, blobs BlobStore) (*Reader, error) {
+	shas := recipe.ChunkSHAs()
+	located, err := index.Locate(ctx, shas)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Reader{
+		ctx:     ctx,
+		blobs:   blobs,
+		chunks:  make([]Chunk, len(shas)),
+		offsets: make([]int64, len(shas)),
+		cache:   make(map[int]*list.Element),
+		lru:     list.New(),
+	}
+	for i, sha := range shas {
+		c, ok := located[sha]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrMissingChunk, sha)
+		}
+		r.chunks[i] = c
+		r.offsets[i] = r.size
+		r.size += int64(c.Size)
+	}
+	return r, nil
+}
+
+// Size is the length of the file
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+// ReadAt implements io.ReaderAt. It may be called concurrently.
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	end := min(off+int64(len(p)), r.size)
+	first := sort.Search(len(r.chunks), func(i int) bool {
+		return r.offsets[i]+int64(r.chunks[i].Size) > off
+	})
+	last := sort.Search(len(r.chunks), func(i int) bool { return r.offsets[i] >= end }) - 1
+
+	chunks, err := r.load(first, last)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for i, data := range chunks {
+		from := max(off-r.offsets[first+i], 0)
+		n += copy(p[n:], data[from:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Read implements io.Reader, reading from the current offset
+func (r *Reader) Read(p []byte) (int, error) {
+	r.lock.Lock()
+	pos := r.pos
+	r.lock.Unlock()
+
+	n, err := r.ReadAt(p, pos)
+	r.lock.Lock()
+	r.pos = pos + int64(n)
+	r.lock.Unlock()
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek implements io.Seeker. Seeking past the end is allowed; reads there
+// return io.EOF.
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// run is a series of chunks stored back to back in one pack, read at once
+type run struct {
+	first, last int
+}
+
+// load returns the decoded chunks first to last, fetching the ones that are
+// not cached
+func (r *Reader) load(first, last int) ([][]byte, error) {
+	out := make([][]byte, last-first+1)
+	var runs []run
+
+	r.lock.Lock()
+	for i := first; i <= last; i++ {
+		if e, ok := r.cache[i]; ok {
+			r.lru.MoveToFront(e)
+			out[i-first] = e.Value.(*cachedChunk).data
+			continue
+		}
+		if n := len(runs); n > 0 && runs[n-1].last == i-1 && r.adjacent(i-1, i) {
+			runs[n-1].last = i
+		} else {
+			runs = append(runs, run{i, i})
+		}
+	}
+	r.lock.Unlock()
+	if len(runs) == 0 {
+		return out, nil
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(runs))
+	slots := make(chan struct{}, maxFetches)
+	for k, rn := range runs {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			errs[k] = r.fetch(rn, out[rn.first-first:rn.last-first+1])
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, rn := range runs {
+		for i := rn.first; i <= rn.last; i++ {
+			if e, ok := r.cache[i]; ok {
+				r.lru.MoveToFront(e)
+				continue
+			}
+			r.cache[i] = r.lru.PushFront(&cachedChunk{i: i, data: out[i-first]})
+			if r.lru.Len() > CacheSize {
+				oldest := r.lru.Remove(r.lru.Back()).(*cachedChunk)
+				delete(r.cache, oldest.i)
+			}
+		}
+	}
+	return out, nil
+}
+
+// adjacent reports whether chunk j is stored right after chunk i
+func (r *Reader) adjacent(i, j int) bool {
+	a, b := r.chunks[i], r.chunks[j]
+	return a.Pack == b.Pack && a.End+1 == b.Start
+}
+
+// fetch reads a run with one range read and decodes its chunks into out
+func (r *Reader) fetch(rn run, out [][]byte) error {
+	head, tail := r.chunks[rn.first], r.chunks[rn.last]
+	stored, err := r.blobs.GetRange(r.ctx, head.Pack, head.Start, tail.End)
+	if err != nil {
+		return err
+	}
+	if int64(len(stored)) != tail.End-head.Start+1 {
+		return fmt.Errorf("short read of %s %d-%d", head.Pack, head.Start, tail.End)
+	}
+
+	for i := rn.first; i <= rn.last; i++ {
+		c := r.chunks[i]
+		data := stored[c.Start-head.Start : c.End-head.Start+1]
+		if c.Decode != nil {
+			if data, err = c.Decode(data); err != nil {
+				return fmt.Errorf("failed to decode chunk %d: %v", i, err)
+			}
+		}
+		if len(data) != c.Size {
+			return fmt.Errorf("chunk %d is %d bytes, want %d", i, len(data), c.Size)
+		}
+		out[i-rn.first] = data
+	}
+	return nil
+}
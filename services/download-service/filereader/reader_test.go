@@ -0,0 +1,271 @@
+package filereader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"testing/iotest"
+)
+
+type recipe []string
+
+func (r recipe) ChunkSHAs() []string { return r }
+
+type index map[string]Chunk
+
+func (x index) Locate(ctx context.Context, shas []string) (map[string]Chunk, error) {
+	located := make(map[string]Chunk)
+	for _, sha := range shas {
+		if c, ok := x[sha]; ok {
+			located[sha] = c
+		}
+	}
+	return located, nil
+}
+
+// blobs is a BlobStore that records the ranges read from it
+type blobs struct {
+	packs map[string][]byte
+
+	lock  sync.Mutex
+	reads []string
+}
+
+func (b *blobs) GetRange(ctx context.Context, key string, start, end int64) ([]byte, error) {
+	b.lock.Lock()
+	b.reads = append(b.reads, fmt.Sprintf("%s %d-%d", key, start, end))
+	b.lock.Unlock()
+	pack, ok := b.packs[key]
+	if !ok {
+		return nil, errors.New("no such pack")
+	}
+	return pack[start : end+1], nil
+}
+
+func (b *blobs) takeReads() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	reads := b.reads
+	b.reads = nil
+	return reads
+}
+
+// reversed stands in for compression: stored bytes are the content backwards
+func reversed(data []byte) []byte {
+	out := make([]byte, len(data))
+	for i, c := range data {
+		out[len(data)-1-i] = c
+	}
+	return out
+}
+
+// testFile stores a file of six chunks of 10 bytes: chunks 0-2 back to back
+// in pack a with chunk 1 encoded, chunk 3 in pack b, chunk 4 the same chunk
+// as chunk 0, and chunk 5 in pack a again but not next to chunk 2
+func testFile(t *testing.T) (*Reader, *blobs, []byte) {
+	t.Helper()
+	type stored struct {
+		pack   string
+		encode bool
+	}
+	layout := []stored{{"a", false}, {"a", true}, {"a", false}, {"b", false}, {"", false}, {"a", false}}
+
+	b := &blobs{packs: map[string][]byte{"a": []byte("padding")}}
+	idx := index{}
+	var shas recipe
+	var content []byte
+	for i, l := range layout {
+		data := []byte(fmt.Sprintf("<chunk %d >", i))
+		if l.pack == "" {
+			data = []byte("<chunk 0 >")
+			shas = append(shas, "sha0")
+			content = append(content, data...)
+			continue
+		}
+		sha := fmt.Sprintf("sha%d", i)
+		if i == 5 {
+			b.packs["a"] = append(b.packs["a"], "gap"...)
+		}
+
+		c := Chunk{Pack: l.pack, Size: len(data)}
+		raw := data
+		if l.encode {
+			raw = reversed(data)
+			c.Decode = func(stored []byte) ([]byte, error) { return reversed(stored), nil }
+		}
+		c.Start = int64(len(b.packs[l.pack]))
+		c.End = c.Start + int64(len(raw)) - 1
+		b.packs[l.pack] = append(b.packs[l.pack], raw...)
+
+		idx[sha] = c
+		shas = append(shas, sha)
+		content = append(content, data...)
+	}
+
+	r, err := Open(context.Background(), shas, idx, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, b, content
+}
+
+func TestReadAt(t *testing.T) {
+	tests := []struct {
+		name  string
+		off   int64
+		n     int
+		reads []string // range reads made
+		err   error
+	}{
+		{"inside a chunk", 2, 5, []string{"a 7-16"}, nil},
+		{"a whole chunk", 10, 10, []string{"a 17-26"}, nil},
+		{"across a boundary", 15, 10, []string{"a 17-36"}, nil},
+		{"across three chunks in one pack", 5, 20, []string{"a 7-36"}, nil},
+		{"across packs", 25, 10, []string{"a 27-36", "b 0-9"}, nil},
+		{"into a repeated chunk", 35, 10, []string{"b 0-9", "a 7-16"}, nil},
+		{"not adjacent in the pack", 45, 10, []string{"a 7-16", "a 40-49"}, nil},
+		{"the whole file", 0, 60, []string{"a 7-36", "b 0-9", "a 7-16", "a 40-49"}, nil},
+		{"past the end", 55, 10, []string{"a 40-49"}, io.EOF},
+		{"at the end", 60, 1, nil, io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, b, content := testFile(t)
+			p := make([]byte, tt.n)
+			n, err := r.ReadAt(p, tt.off)
+			if err != tt.err {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			want := content[min(tt.off, int64(len(content))):min(tt.off+int64(tt.n), int64(len(content)))]
+			if !bytes.Equal(p[:n], want) {
+				t.Errorf("read %q, want %q", p[:n], want)
+			}
+
+			// Runs are fetched concurrently, in no particular order
+			if reads := b.takeReads(); !sameSet(reads, tt.reads) {
+				t.Errorf("read ranges %v, want %v", reads, tt.reads)
+			}
+
+			// The chunks are cached now
+			if _, err := r.ReadAt(p, tt.off); err != tt.err {
+				t.Fatal(err)
+			}
+			if reads := b.takeReads(); len(reads) != 0 {
+				t.Errorf("second read fetched %v", reads)
+			}
+		})
+	}
+}
+
+func sameSet(a, b []string) bool {
+	count := make(map[string]int)
+	for _, s := range a {
+		count[s]++
+	}
+	for _, s := range b {
+		count[s]--
+	}
+	for _, n := range count {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSeek(t *testing.T) {
+	r, _, content := testFile(t)
+
+	steps := []struct {
+		offset int64
+		whence int
+		pos    int64
+		read   int
+		want   string
+	}{
+		{8, io.SeekStart, 8, 4, string(content[8:12])},
+		{5, io.SeekCurrent, 17, 6, string(content[17:23])},
+		{-3, io.SeekEnd, 57, 10, string(content[57:])},
+		{-30, io.SeekCurrent, 30, 0, ""},
+		{100, io.SeekStart, 100, 1, ""},
+	}
+	for i, s := range steps {
+		pos, err := r.Seek(s.offset, s.whence)
+		if err != nil || pos != s.pos {
+			t.Fatalf("step %d: seek to %d, %v, want %d", i, pos, err, s.pos)
+		}
+		p := make([]byte, s.read)
+		n, err := io.ReadFull(r, p)
+		if string(p[:n]) != s.want {
+			t.Errorf("step %d: read %q, want %q", i, p[:n], s.want)
+		}
+		if n < s.read && err == nil {
+			t.Errorf("step %d: short read without an error", i)
+		}
+	}
+
+	if _, err := r.Seek(-1, io.SeekStart); err == nil {
+		t.Error("seek before the start succeeded")
+	}
+	if _, err := r.Seek(0, 42); err == nil {
+		t.Error("seek with an invalid whence succeeded")
+	}
+}
+
+func TestReader(t *testing.T) {
+	r, _, content := testFile(t)
+	if r.Size() != int64(len(content)) {
+		t.Fatalf("size %d, want %d", r.Size(), len(content))
+	}
+	if err := iotest.TestReader(r, content); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOpenMissingChunk(t *testing.T) {
+	_, err := Open(context.Background(), recipe{"sha0", "unknown"}, index{"sha0": {Pack: "a", Size: 1}}, &blobs{})
+	if !errors.Is(err, ErrMissingChunk) {
+		t.Errorf("got %v, want ErrMissingChunk", err)
+	}
+}
+
+func TestReadFailures(t *testing.T) {
+	tests := []struct {
+		name  string
+		chunk Chunk
+	}{
+		{"decode fails", Chunk{Pack: "a", Start: 0, End: 3, Size: 4, Decode: func([]byte) ([]byte, error) { return nil, errors.New("bad") }}},
+		{"decodes to the wrong size", Chunk{Pack: "a", Start: 0, End: 3, Size: 5}},
+		{"pack missing", Chunk{Pack: "b", Start: 0, End: 3, Size: 4}},
+		{"short pack", Chunk{Pack: "a", Start: 2, End: 9, Size: 8}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &blobs{packs: map[string][]byte{"a": []byte("data")}}
+			r, err := Open(context.Background(), recipe{"sha"}, index{"sha": tt.chunk}, shortBlobs{b})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := r.ReadAt(make([]byte, 1), 0); err == nil || err == io.EOF {
+				t.Errorf("read succeeded: %v", err)
+			}
+		})
+	}
+}
+
+// shortBlobs returns what a pack holds of a range instead of failing
+type shortBlobs struct {
+	*blobs
+}
+
+func (s shortBlobs) GetRange(ctx context.Context, key string, start, end int64) ([]byte, error) {
+	pack, ok := s.packs[key]
+	if !ok {
+		return nil, errors.New("no such pack")
+	}
+	return pack[min(start, int64(len(pack))):min(end+1, int64(len(pack)))], nil
+}
@@ -3,15 +3,10 @@ package main
 import (
 	"context"
 	"encoding/base64"
-	"encoding/json"
 	"fmt"
 	"log"
-	"os"
-	"sort"
-	"sync"
 
 	"github.com/gorilla/websocket"
-	"github.com/redis/go-redis/v9"
 )
 
 type ChunkMeta struct {
@@ -19,153 +14,97 @@ type ChunkMeta struct {
 	Start    int    `json:"start"`
 	End      int    `json:"end"`
 	No       int    `json:"no"`
+
+	// Codec is how the stored bytes are compressed ("" for raw, "gzip" or
+	// "zstd"). The stored length is End-Start+1; Size is the length once
+	// decoded, 0 for chunks packed before compression existed.
+	Codec string `json:"codec,omitempty"`
+	Size  int    `json:"size,omitempty"`
+
+	// KeyID names the key the stored bytes are encrypted with, "" when they
+	// are not encrypted
+	KeyID string `json:"key_id,omitempty"`
+
+	// Seen is the unix time the chunk was last packed or deduplicated
+	// against; GC never collects a chunk seen within its grace period
+	Seen int64 `json:"seen,omitempty"`
+
+	// SHA is filled in on lookup; it is the key, so it is not stored
+	SHA string `json:"-"`
 }
 
 var ctx = context.Background()
 
-// OrganizeAndSortChunks groups by filename, sorts by start byte
-
-func FetchChunkMetadata(rdb *redis.Client, keys []string) ([]ChunkMeta, error) {
+// FetchChunkMetadata looks up shas in a dedup domain in order, skipping
+// unknown ones. No is set to the position in shas so ranges can be put back in
+// file order.
+func FetchChunkMetadata(index ChunkIndex, domain string, shas []string) ([]ChunkMeta, error) {
 	result := []ChunkMeta{}
 
-	values, err := rdb.MGet(ctx, keys...).Result()
+	keys := make([]string, len(shas))
+	for i, sha := range shas {
+		keys[i] = chunkKey(domain, sha)
+	}
+	metas, err := index.Get(ctx, keys)
 	if err != nil {
-		return nil, fmt.Errorf("redis MGet failed: %v", err)
+		return nil, err
 	}
 
-	for i, val := range values {
-		if val == nil {
-			continue
-		}
-
-		strVal, ok := val.(string)
+	for i, key := range keys {
+		meta, ok := metas[key]
 		if !ok {
-			return nil, fmt.Errorf("invalid type for key %s", keys[i])
-		}
-
-		var meta ChunkMeta
-		if err := json.Unmarshal([]byte(strVal), &meta); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal value for key %s: %v", keys[i], err)
+			continue
 		}
 		meta.No = i
+		meta.SHA = shas[i]
 
 		result = append(result, meta)
-
 	}
 
 	return result, nil
 }
 
-type Wrapper struct {
-	ChunkNo int
-	Data    []byte
-	Err     error
-}
-
-func DownloadAndAssembleFiles(metaMap map[string][][]int) {
-	var wg sync.WaitGroup
-	ch := make(chan Wrapper, 100)
-
-	for filename, ranges := range metaMap {
-		for _, chunk := range ranges {
-			if len(chunk) != 3 {
-				fmt.Println("⚠️ Invalid chunk format, expected [chunkNo, start, end]")
-				continue
-			}
-			chunkNo := chunk[0]
-			start := chunk[1]
-			end := chunk[2]
-
-			wg.Add(1)
-			go func(f string, no, s, e int) {
-				defer wg.Done()
-				data, err := FetchByteRangeFromS3(f, s, e)
-				ch <- Wrapper{ChunkNo: no, Data: data, Err: err}
-			}(filename, chunkNo, start, end)
-		}
-	}
-
-	go func() {
-		wg.Wait()
-		close(ch)
-	}()
-
-	var finalSlice []Wrapper
-	for wrapper := range ch {
-		if wrapper.Err != nil {
-			fmt.Printf("❌ Failed to fetch chunk %d: %v\n", wrapper.ChunkNo, wrapper.Err)
-			continue
-		}
-		finalSlice = append(finalSlice, wrapper)
-	}
-
-	// Sort by chunk number
-	sort.Slice(finalSlice, func(i, j int) bool {
-		return finalSlice[i].ChunkNo < finalSlice[j].ChunkNo
-	})
-
-	outputFile := "output.pdf"
-	f, err := os.OpenFile(outputFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+// fetchRange reads a run of stored chunks with one ranged GET and decodes
+// each of them, returning their content back to back
+func fetchRange(ctx context.Context, filename string, r ChunkRange) ([]byte, error) {
+	stored, err := Blobs.GetRange(ctx, filename, int64(r.Start), int64(r.End))
 	if err != nil {
-		fmt.Printf("❌ Failed to create output file: %v\n", err)
-		return
+		return nil, err
+	}
+	if len(stored) != r.End-r.Start+1 {
+		return nil, fmt.Errorf("short read of %s %d-%d", filename, r.Start, r.End)
 	}
-	defer f.Close()
 
-	for _, wrapper := range finalSlice {
-		_, err := f.Write(wrapper.Data)
+	var out []byte
+	for _, m := range r.Members {
+		data, err := decodeChunk(m, stored[m.Start-r.Start:m.End-r.Start+1])
 		if err != nil {
-			fmt.Printf("❌ Failed to write chunk %d: %v\n", wrapper.ChunkNo, err)
+			return nil, err
 		}
+		out = append(out, data...)
 	}
-
-	fmt.Println("✅ All chunks successfully written to output.pdf")
-}
-
-func DownloadAndStreamChunks(metaMap map[string][][]int, conn *websocket.Conn) {
-	var wg sync.WaitGroup
-	ch := make(chan Wrapper, 100)
-
-	for filename, ranges := range metaMap {
-		for _, chunk := range ranges {
-			if len(chunk) != 3 {
-				fmt.Println("⚠️ Invalid chunk format, expected [chunkNo, start, end]")
-				continue
-			}
-			chunkNo := chunk[0]
-			start := chunk[1]
-			end := chunk[2]
-
-			wg.Add(1)
-			go func(f string, no, s, e int) {
-				defer wg.Done()
-				data, err := FetchByteRangeFromS3(f, s, e)
-				ch <- Wrapper{ChunkNo: no, Data: data, Err: err}
-			}(filename, chunkNo, start, end)
-		}
+	if r.Skip+r.Drop > len(out) {
+		return nil, fmt.Errorf("range %s %d-%d decoded to %d bytes, too few to trim", filename, r.Start, r.End, len(out))
 	}
+	return out[r.Skip : len(out)-r.Drop], nil
+}
 
-	go func() {
-		wg.Wait()
-		close(ch)
-	}()
-
-	for wrapper := range ch {
-		if wrapper.Err != nil {
-			log.Printf("❌ Failed to fetch chunk %d: %v\n", wrapper.ChunkNo, wrapper.Err)
-			continue
-		}
-
-		err := conn.WriteJSON(struct {
+// DownloadAndStreamChunks sends a file as JSON frames in file order. A
+// failure ends the stream with an error frame.
+func DownloadAndStreamChunks(metaMap map[string][]ChunkRange, conn *websocket.Conn) {
+	err := streamRanges(ctx, metaMap, func(no int, data []byte) error {
+		return conn.WriteJSON(struct {
 			ChunkNo int    `json:"chunk_no"`
 			Data    string `json:"data"` // base64 encoded
 		}{
-			ChunkNo: wrapper.ChunkNo,
-			Data:    base64.StdEncoding.EncodeToString(wrapper.Data),
+			ChunkNo: no,
+			Data:    base64.StdEncoding.EncodeToString(data),
+		})
+	})
+	if err != nil {
+		log.Printf("❌ Failed to stream file: %v", err)
+		conn.WriteJSON(map[string]string{
+			"error": err.Error(),
 		})
-		if err != nil {
-			log.Printf(" Failed to send chunk %d: %v", wrapper.ChunkNo, err)
-			break
-		}
 	}
 }
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// The upload service encrypts chunks at rest with AES-256-GCM (see keys.go
+// there); the download service only ever decrypts. A stored chunk is nonce
+// (12 bytes) followed by the ciphertext and tag, with the chunk's SHA as
+// additional data. KEY_PROVIDER, KEY_FILE, KEY_MASTER and KEY_SECRET must
+// match the upload service.
+type KeyProvider interface {
+	// Key looks up a key by ID
+	Key(ctx context.Context, id string) ([]byte, error)
+}
+
+var Keys KeyProvider
+
+var ErrUnknownKey = errors.New("unknown encryption key")
+
+func InitKeys() {
+	switch provider := os.Getenv("KEY_PROVIDER"); provider {
+	case "":
+	case "local":
+		path := os.Getenv("KEY_FILE")
+		if path == "" {
+			path = "keys.json"
+		}
+		p, err := NewLocalKeyProvider(path)
+		if err != nil {
+			log.Fatalf("Failed to load key file: %v", err)
+		}
+		Keys = p
+		log.Printf("Decrypting chunks with keys from %s", path)
+	case "envelope":
+		master, err := base64.StdEncoding.DecodeString(os.Getenv("KEY_MASTER"))
+		if err != nil || len(master) != 32 {
+			log.Fatal("KEY_MASTER must be a base64 encoded 32 byte key")
+		}
+		Keys = NewEnvelopeKeyProvider(master, Blobs)
+		log.Println("Decrypting chunks with envelope keys")
+	case "convergent":
+		p, err := NewConvergentKeyProvider(os.Getenv("KEY_SECRET"))
+		if err != nil {
+			log.Fatalf("Invalid KEY_SECRET: %v", err)
+		}
+		Keys = p
+		log.Println("Decrypting chunks with convergent keys")
+	default:
+		log.Fatalf("Unknown KEY_PROVIDER %q (expected local, envelope or convergent)", provider)
+	}
+}
+
+// openChunk decrypts the stored bytes of a chunk, returning them unchanged
+// when the chunk is not encrypted
+func openChunk(meta ChunkMeta, data []byte) ([]byte, error) {
+	if meta.KeyID == "" {
+		return data, nil
+	}
+	if Keys == nil {
+		return nil, fmt.Errorf("chunk is encrypted with key %s but KEY_PROVIDER is not set", meta.KeyID)
+	}
+	key, err := Keys.Key(ctx, meta.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	aad, err := hex.DecodeString(meta.SHA)
+	if err != nil {
+		return nil, err
+	}
+
+	if isConvergentKey(meta.KeyID) {
+		key = convergentChunkKey(key, aad)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize()+gcm.Overhead() {
+		return nil, errors.New("encrypted chunk is too short")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], aad)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt chunk with key %s: %v", meta.KeyID, err)
+	}
+	return plain, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// LocalKeyProvider reads keys from the same JSON file as the upload service:
+//
+//	{"current": "2025-01", "keys": {"2025-01": "<base64 32 bytes>"}}
+type LocalKeyProvider struct {
+	keys map[string][]byte
+}
+
+func NewLocalKeyProvider(path string) (*LocalKeyProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		Keys map[string]string `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	p := &LocalKeyProvider{keys: make(map[string][]byte)}
+	for id, encoded := range file.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("key %s must be a base64 encoded 32 byte key", id)
+		}
+		p.keys[id] = key
+	}
+	return p, nil
+}
+
+func (p *LocalKeyProvider) Key(ctx context.Context, id string) ([]byte, error) {
+	key, ok := p.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrUnknownKey, id)
+	}
+	return key, nil
+}
+
+// EnvelopeKeyProvider unwraps the data keys the upload service stores under
+// keys/ with the master key, caching them once unwrapped
+type EnvelopeKeyProvider struct {
+	master []byte
+	store  BlobStore
+
+	lock  sync.RWMutex
+	cache map[string][]byte
+}
+
+const envelopeKeyPrefix = "keys/"
+
+func NewEnvelopeKeyProvider(master []byte, store BlobStore) *EnvelopeKeyProvider {
+	return &EnvelopeKeyProvider{master: master, store: store, cache: make(map[string][]byte)}
+}
+
+func (p *EnvelopeKeyProvider) Key(ctx context.Context, id string) ([]byte, error) {
+	p.lock.RLock()
+	key, ok := p.cache[id]
+	p.lock.RUnlock()
+	if ok {
+		return key, nil
+	}
+
+	info, err := p.store.Head(ctx, envelopeKeyPrefix+id)
+	if errors.Is(err, ErrBlobNotFound) {
+		return nil, fmt.Errorf("%w %s", ErrUnknownKey, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := p.store.GetRange(ctx, envelopeKeyPrefix+id, 0, info.Size-1)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(p.master)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < gcm.NonceSize() {
+		return nil, fmt.Errorf("wrapped key %s is too short", id)
+	}
+	key, err = gcm.Open(nil, wrapped[:gcm.NonceSize()], wrapped[gcm.NonceSize():], []byte(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap key %s: %v", id, err)
+	}
+
+	p.lock.Lock()
+	p.cache[id] = key
+	p.lock.Unlock()
+	return key, nil
+}
+
+// ConvergentKeyProvider holds the KEY_SECRET secrets each chunk's key is
+// derived from; see the upload service for how and for the tradeoffs
+type ConvergentKeyProvider struct {
+	secrets map[string][]byte
+}
+
+const convergentKeyPrefix = "convergent-"
+
+// NewConvergentKeyProvider takes the same comma separated base64 secrets as
+// the upload service
+func NewConvergentKeyProvider(secrets string) (*ConvergentKeyProvider, error) {
+	p := &ConvergentKeyProvider{secrets: make(map[string][]byte)}
+	for _, encoded := range strings.Split(secrets, ",") {
+		secret, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil || len(secret) < 32 {
+			return nil, errors.New("each secret must be base64 encoded and at least 32 bytes")
+		}
+		p.secrets[convergentKeyID(secret)] = secret
+	}
+	return p, nil
+}
+
+func (p *ConvergentKeyProvider) Key(ctx context.Context, id string) ([]byte, error) {
+	secret, ok := p.secrets[id]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrUnknownKey, id)
+	}
+	return secret, nil
+}
+
+func convergentKeyID(secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("neurostore key id"))
+	return convergentKeyPrefix + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+func isConvergentKey(id string) bool {
+	return strings.HasPrefix(id, convergentKeyPrefix)
+}
+
+// convergentChunkKey derives the key of one chunk from the secret and its SHA
+func convergentChunkKey(secret, sha []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(sha)
+	return mac.Sum(nil)
+}
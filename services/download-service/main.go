@@ -1,22 +1,27 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
-	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/gorilla/websocket"
 	"github.com/rs/cors"
 )
 
 type ChunkData struct {
-	ChunkNo int    `json:"chunk_no"`
-	SHA     string `json:"sha"`
-	Start   int    `json:"start"`
-	End     int    `json:"end"`
+	ChunkNo int    `json:"chunk_no" bson:"chunk_no"`
+	SHA     string `json:"sha" bson:"sha"`
+	Start   int    `json:"start" bson:"start"`
+	End     int    `json:"end" bson:"end"`
 }
 
 // func merge(chunks []ChunkMeta) []ChunkMeta {
@@ -46,7 +51,23 @@ type ChunkData struct {
 // 	return result
 // }
 
-func OrganizeAndSortChunks(metas []ChunkMeta) map[string][][]int {
+// ChunkRange is a run of chunks stored back to back in one pack, fetched with
+// a single ranged GET. No is the No of the first chunk and puts the run back
+// in file order; Members keeps each chunk so it can be decoded on its own.
+// Skip and Drop trim the decoded run for downloads of part of a file.
+type ChunkRange struct {
+	No      int
+	Start   int
+	End     int
+	Members []ChunkMeta
+	Skip    int
+	Drop    int
+}
+
+// OrganizeAndSortChunks merges consecutive chunks that sit next to each other
+// in the same pack. Offsets are stored offsets, so this works the same for
+// compressed chunks.
+func OrganizeAndSortChunks(metas []ChunkMeta) map[string][]ChunkRange {
 	// sort.Slice(metas, func(i, j int) bool {
 	// 	if metas[i].Filename == metas[j].Filename {
 	// 		return metas[i].Start < metas[j].Start
@@ -54,109 +75,218 @@ func OrganizeAndSortChunks(metas []ChunkMeta) map[string][][]int {
 	// 	return metas[i].Filename < metas[j].Filename
 	// })
 
-	filerange := make(map[string][][]int)
+	filerange := make(map[string][]ChunkRange)
 
 	if len(metas) == 0 {
 		return filerange
 	}
 
-	cur_chunkno := metas[0].No
-	cur_start := metas[0].Start
-	cur_end := metas[0].End
+	cur := ChunkRange{No: metas[0].No, Start: metas[0].Start, End: metas[0].End, Members: []ChunkMeta{metas[0]}}
 	cur_file := metas[0].Filename
 
 	for i := 1; i < len(metas); i++ {
 		next := metas[i]
-		if cur_end+1 == next.Start && cur_file == next.Filename {
-			cur_end = next.End
+		if cur.End+1 == next.Start && cur_file == next.Filename {
+			cur.End = next.End
+			cur.Members = append(cur.Members, next)
 		} else {
-			filerange[cur_file] = append(filerange[cur_file], []int{cur_chunkno, cur_start, cur_end})
-			cur_chunkno = next.No
-			cur_start = next.Start
-			cur_end = next.End
+			filerange[cur_file] = append(filerange[cur_file], cur)
+			cur = ChunkRange{No: next.No, Start: next.Start, End: next.End, Members: []ChunkMeta{next}}
 			cur_file = next.Filename
 		}
 	}
 	// add the last range
-	filerange[cur_file] = append(filerange[cur_file], []int{cur_chunkno, cur_start, cur_end})
-
-	// 🔍 Debug print map:
-	fmt.Println("📦 Final merged file ranges:")
-	for file, ranges := range filerange {
-		fmt.Printf("File: %s -> ", file)
-		for _, r := range ranges {
-			fmt.Printf("[No=%d Start=%d End=%d] ", r[0], r[1], r[2])
-		}
-		fmt.Println()
-	}
+	filerange[cur_file] = append(filerange[cur_file], cur)
 
 	return filerange
 }
 
+// FileRequest names the file to download, the latest version for version 0
+type FileRequest struct {
+	FileID  string `json:"file_id"`
+	Version int    `json:"version"`
+}
+
+// getFileHandler serves POST /getfile, the same download as GET /files/{id}
+// with the file named in the body
 func getFileHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Failed to read body", http.StatusBadRequest)
+	var req FileRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil || req.FileID == "" {
+		http.Error(w, "Expected {\"file_id\": ..., \"version\": ...}", http.StatusBadRequest)
 		return
 	}
 	defer r.Body.Close()
 
-	fmt.Println("🔵 Raw JSON received:")
-	fmt.Println(string(body))
+	serveFile(w, r, req)
+}
 
-	var chunks []ChunkData
-	if err := json.Unmarshal(body, &chunks); err != nil {
-		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
-		fmt.Println(" Failed to parse JSON:", err)
-		return
+// fileHandler serves GET and HEAD /files/{id}?version=N
+func fileHandler(w http.ResponseWriter, r *http.Request) {
+	req := FileRequest{FileID: r.PathValue("id")}
+	if v := r.URL.Query().Get("version"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid version", http.StatusBadRequest)
+			return
+		}
+		req.Version = n
 	}
 
-	sort.Slice(chunks, func(i, j int) bool {
-		return chunks[i].ChunkNo < chunks[j].ChunkNo
-	})
+	serveFile(w, r, req)
+}
 
-	var shaKeys []string
-	for _, c := range chunks {
-		fmt.Printf("Chunk %d: SHA=%s, Offset=%d-%d",
-			c.ChunkNo, c.SHA, c.Start, c.End)
-		shaKeys = append(shaKeys, c.SHA)
+// serveFile streams a file, or the parts of it named by a Range header, into
+// the response. The status is sent with the first bytes read, so a file that
+// cannot be read at all gets an error status; after that a failed fetch can
+// only abort the connection, which clients see as a body shorter than
+// Content-Length.
+func serveFile(w http.ResponseWriter, r *http.Request, req FileRequest) {
+	caller, err := authenticate(r)
+	if err != nil && !errors.Is(err, ErrNoToken) {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
 	}
 
-	// Fetch metadata from Redis
-	metas, err := FetchChunkMetadata(RedisClient, shaKeys)
+	d, err := openFile(caller, req.FileID, req.Version)
 	if err != nil {
-		http.Error(w, "Failed to fetch metadata", http.StatusInternalServerError)
-		fmt.Println(" Redis fetch error:", err)
+		log.Printf("Download of %s v%d by %q refused: %v", req.FileID, req.Version, caller.UserID, err)
+		http.Error(w, err.Error(), downloadStatus(err))
 		return
 	}
 
-	grouped := OrganizeAndSortChunks(metas)
-	//print the map i wanna see something first
+	contentType := fileContentType(d.File)
+	h := w.Header()
+	h.Set("Content-Type", contentType)
+	h.Set("X-Content-Type-Options", "nosniff")
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": d.File.Name})
+	if disposition == "" {
+		disposition = "attachment"
+	}
+	h.Set("Content-Disposition", disposition)
+	h.Set("ETag", d.ETag)
+	h.Set("Cache-Control", "private, no-cache")
+	h.Set("Accept-Ranges", "bytes")
+	if etagMatches(r.Header.Get("If-None-Match"), d.ETag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if r.Method == http.MethodHead {
+		h.Set("Content-Length", strconv.FormatInt(d.Size, 10))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
 
-	DownloadAndAssembleFiles(grouped)
+	// A Range is only honoured for the version named by If-Range, if any
+	var ranges []byteRange
+	if rh := r.Header.Get("Range"); rh != "" {
+		if ir := r.Header.Get("If-Range"); ir == "" || ir == d.ETag {
+			ranges, err = parseRange(rh, d.Size)
+			if err != nil {
+				for _, k := range []string{"Content-Disposition", "ETag"} {
+					h.Del(k)
+				}
+				h.Set("Content-Range", fmt.Sprintf("bytes */%d", d.Size))
+				http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+		}
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"status":"ok"}`))
+	log.Printf("Downloading %s v%d (%d chunks, %d ranges) for %q", d.File.FileID, d.File.Version, len(d.File.Chunks), len(ranges), caller.UserID)
+	body := &lazyWriter{w: w, status: http.StatusPartialContent}
+	switch len(ranges) {
+	case 0:
+		body.status = http.StatusOK
+		h.Set("Content-Length", strconv.FormatInt(d.Size, 10))
+		err = writePlan(r.Context(), body, d.Plan)
+	case 1:
+		h.Set("Content-Range", ranges[0].contentRange(d.Size))
+		h.Set("Content-Length", strconv.FormatInt(ranges[0].length(), 10))
+		err = writePlan(r.Context(), body, d.planRange(ranges[0]))
+	default:
+		mw := multipart.NewWriter(body)
+		h.Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+		h.Set("Content-Length", strconv.FormatInt(multipartSize(ranges, contentType, d.Size, mw.Boundary()), 10))
+		for _, rng := range ranges {
+			var part io.Writer
+			part, err = mw.CreatePart(rangesHeader(rng, contentType, d.Size))
+			if err == nil {
+				err = writePlan(r.Context(), part, d.planRange(rng))
+			}
+			if err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+	}
+	if err == nil && !body.started {
+		w.WriteHeader(body.status)
+	}
+	if err != nil {
+		log.Printf("Download of %s v%d failed: %v", d.File.FileID, d.File.Version, err)
+		if body.started {
+			panic(http.ErrAbortHandler)
+		}
+		for _, k := range []string{"Content-Disposition", "Content-Length", "Content-Range", "ETag"} {
+			h.Del(k)
+		}
+		http.Error(w, "Failed to read file", http.StatusBadGateway)
+	}
+}
+
+// writePlan streams a download plan into w in file order
+func writePlan(ctx context.Context, w io.Writer, plan map[string][]ChunkRange) error {
+	return streamRanges(ctx, plan, func(no int, data []byte) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// fileContentType is the stored MIME type, or a guess from the extension
+func fileContentType(file *FileManifest) string {
+	if file.MimeType != "" {
+		return file.MimeType
+	}
+	if t := mime.TypeByExtension("." + file.Extension); file.Extension != "" && t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// etagMatches reports whether an If-None-Match header names etag
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
 }
 
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins (customize as needed)
-	},
+	CheckOrigin: checkOrigin,
 }
 
 type WSMessage struct {
-	Type string      `json:"type"` // "chunk" or "end"
-	Data []ChunkData `json:"data"`
+	Type string `json:"type"` // "file"
+	FileRequest
 }
 
 func wsGetFileHandler(w http.ResponseWriter, r *http.Request) {
+	caller, err := authenticate(r)
+	if err != nil && !errors.Is(err, ErrNoToken) {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(" WebSocket upgrade failed:", err)
@@ -164,9 +294,7 @@ func wsGetFileHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer conn.Close()
 
-	log.Println(" WebSocket connection established")
-
-	var collectedChunks []ChunkData // <-- collect until we receive "end"
+	log.Printf(" WebSocket connection established for %q", caller.UserID)
 
 	for {
 		_, message, err := conn.ReadMessage()
@@ -175,9 +303,6 @@ func wsGetFileHandler(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 
-		log.Println(" WebSocket received data:")
-		log.Println(string(message))
-
 		var msg WSMessage
 		if err := json.Unmarshal(message, &msg); err != nil {
 			log.Println(" Failed to parse WSMessage:", err)
@@ -188,35 +313,20 @@ func wsGetFileHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		switch msg.Type {
-		case "chunk":
-			collectedChunks = append(collectedChunks, msg.Data...)
-			log.Printf(" Appended %d chunks (total: %d)", len(msg.Data), len(collectedChunks))
-
-		case "end":
-			log.Println(" Received 'end' signal. Processing chunks...")
-
-			sort.Slice(collectedChunks, func(i, j int) bool {
-				return collectedChunks[i].ChunkNo < collectedChunks[j].ChunkNo
-			})
-
-			var shaKeys []string
-			for _, c := range collectedChunks {
-				log.Printf("Chunk %d: SHA=%s, Offset=%d-%d", c.ChunkNo, c.SHA, c.Start, c.End)
-				shaKeys = append(shaKeys, c.SHA)
-			}
-
-			metas, err := FetchChunkMetadata(RedisClient, shaKeys)
+		case "file":
+			d, err := openFile(caller, msg.FileID, msg.Version)
 			if err != nil {
+				log.Printf("Download of %s v%d by %q refused: %v", msg.FileID, msg.Version, caller.UserID, err)
 				conn.WriteJSON(map[string]string{
-					"error": "Failed to fetch metadata",
+					"error": err.Error(),
 				})
-				break
+				return
 			}
+			log.Printf("Streaming %s v%d (%d chunks) for %q", d.File.FileID, d.File.Version, len(d.File.Chunks), caller.UserID)
 
-			grouped := OrganizeAndSortChunks(metas)
-			DownloadAndStreamChunks(grouped, conn)
+			DownloadAndStreamChunks(d.Plan, conn)
 			log.Println(" File streaming complete. Closing connection.")
-			return // or break
+			return
 
 		default:
 			log.Println(" Unknown message type:", msg.Type)
@@ -228,14 +338,28 @@ func wsGetFileHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
-	InitRedis()
-	InitS3()
+	InitChunkIndex()
+	InitBlobStore()
+	InitKeys()
+	InitAuth()
+	InitDedupDomain()
+	InitStreaming()
+	InitFetchScheduler()
+	InitManifestStore()
+	StartAdminServer()
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/getfile", getFileHandler)
+	mux.HandleFunc("GET /files/{id}", fileHandler)
 	mux.HandleFunc("/ws-getfile", wsGetFileHandler)
 
-	handler := cors.Default().Handler(mux)
+	handler := cors.New(cors.Options{
+		AllowOriginFunc:  func(origin string) bool { return allowedOrigins["*"] || allowedOrigins[origin] },
+		AllowedMethods:   []string{"GET", "HEAD", "POST"},
+		AllowedHeaders:   []string{"Content-Type", "Authorization", "Range", "If-Range"},
+		ExposedHeaders:   []string{"Accept-Ranges", "Content-Disposition", "Content-Length", "Content-Range", "ETag"},
+		AllowCredentials: true,
+	}).Handler(mux)
 
 	fmt.Println("🚀 Server running on http://localhost:3001")
 	if err := http.ListenAndServe(":3001", handler); err != nil {
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"go.mongodb.org/mongo-driver/v2/x/mongo/driver/connstring"
+)
+
+// Downloads name a file and a version. The recipe and the rules for who may
+// read the file come from the backend's MongoDB, never from the client, so
+// the download service enforces the same access as the backend: the owner,
+// anyone the file is shared with, and everyone for public files.
+
+// SharedAccess is an entry of a file's shared_with list. The backend matches
+// it against the user's id, GitHub id or Gmail address.
+type SharedAccess struct {
+	UserID   string `bson:"user_id"`
+	GithubID string `bson:"github_id"`
+	Gmail    string `bson:"gmail"`
+}
+
+// FileManifest is one version of a file: what the backend stores about it and
+// its recipe in file order
+type FileManifest struct {
+	FileID     string
+	Name       string
+	Extension  string
+	MimeType   string
+	Size       int64
+	Version    int
+	Owner      string
+	IsPublic   bool
+	SharedWith []SharedAccess
+	Chunks     []ChunkData
+
+	// Domain is the dedup domain the version's chunks were uploaded to, as
+	// recorded with its recipe; nil for recipes from before it was recorded
+	Domain *string
+}
+
+// UserIdentity is what shared_with entries may name a user by
+type UserIdentity struct {
+	GithubID string
+	Gmail    string
+}
+
+// ManifestStore reads files, their recipes and their users
+type ManifestStore interface {
+	// File returns a version of a file, the latest for version 0
+	File(ctx context.Context, fileID string, version int) (*FileManifest, error)
+	User(ctx context.Context, userID string) (UserIdentity, error)
+}
+
+var Manifests ManifestStore
+
+var (
+	ErrFileNotFound  = errors.New("file not found")
+	ErrLoginRequired = errors.New("file is not public, log in to download it")
+	ErrAccessDenied  = errors.New("access denied")
+)
+
+// MongoManifestStore reads the backend's files, metadata and users
+// collections
+type MongoManifestStore struct {
+	db *mongo.Database
+}
+
+// InitManifestStore connects to the backend's MongoDB at MONGO_URI. The
+// database is taken from the URI, like the backend does.
+func InitManifestStore() {
+	uri := os.Getenv("MONGO_URI")
+	if uri == "" {
+		log.Fatal("MONGO_URI environment variable is not defined")
+	}
+
+	cs, err := connstring.ParseAndValidate(uri)
+	if err != nil {
+		log.Fatalf("Invalid MONGO_URI: %v", err)
+	}
+	dbName := cs.Database
+	if dbName == "" {
+		dbName = "test"
+	}
+
+	client, err := mongo.Connect(options.Client().ApplyURI(uri))
+	if err != nil {
+		log.Fatalf("Failed to connect to MongoDB: %v", err)
+	}
+
+	pingCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err := client.Ping(pingCtx, nil); err != nil {
+		log.Fatalf("Failed to reach MongoDB: %v", err)
+	}
+
+	Manifests = &MongoManifestStore{db: client.Database(dbName)}
+	log.Printf("Reading file manifests from MongoDB database %s", dbName)
+}
+
+func (m *MongoManifestStore) File(ctx context.Context, fileID string, version int) (*FileManifest, error) {
+	var file struct {
+		FileID     string         `bson:"file_id"`
+		User       bson.ObjectID  `bson:"user"`
+		Name       string         `bson:"file_name"`
+		Extension  string         `bson:"file_extension"`
+		MimeType   string         `bson:"mime_type"`
+		Size       int64          `bson:"file_size"`
+		IsPublic   bool           `bson:"is_public"`
+		SharedWith []SharedAccess `bson:"shared_with"`
+		Metadata   []struct {
+			ID      bson.ObjectID `bson:"_id"`
+			Version int           `bson:"version"`
+		} `bson:"metadata"`
+	}
+	err := m.db.Collection("files").FindOne(ctx, bson.D{{Key: "file_id", Value: fileID}}).Decode(&file)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrFileNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %s: %v", fileID, err)
+	}
+
+	found := -1
+	for i, v := range file.Metadata {
+		if version == 0 {
+			if found < 0 || v.Version > file.Metadata[found].Version {
+				found = i
+			}
+		} else if v.Version == version {
+			found = i
+		}
+	}
+	if found < 0 {
+		return nil, ErrFileNotFound
+	}
+	entry := file.Metadata[found]
+
+	var recipe struct {
+		Chunks []ChunkData `bson:"chunks"`
+		Domain *string     `bson:"domain"`
+	}
+	err = m.db.Collection("metadata").FindOne(ctx, bson.D{{Key: "_id", Value: entry.ID}}).Decode(&recipe)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrFileNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata of file %s: %v", fileID, err)
+	}
+	for i := range recipe.Chunks {
+		recipe.Chunks[i].SHA = strings.ToLower(recipe.Chunks[i].SHA)
+	}
+	sort.Slice(recipe.Chunks, func(i, j int) bool {
+		return recipe.Chunks[i].ChunkNo < recipe.Chunks[j].ChunkNo
+	})
+
+	return &FileManifest{
+		FileID:     file.FileID,
+		Name:       file.Name,
+		Extension:  file.Extension,
+		MimeType:   file.MimeType,
+		Size:       file.Size,
+		Version:    entry.Version,
+		Owner:      file.User.Hex(),
+		IsPublic:   file.IsPublic,
+		SharedWith: file.SharedWith,
+		Chunks:     recipe.Chunks,
+		Domain:     recipe.Domain,
+	}, nil
+}
+
+func (m *MongoManifestStore) User(ctx context.Context, userID string) (UserIdentity, error) {
+	id, err := bson.ObjectIDFromHex(userID)
+	if err != nil {
+		return UserIdentity{}, nil
+	}
+
+	var user struct {
+		GithubID string `bson:"github_id"`
+		Gmail    string `bson:"gmail"`
+	}
+	err = m.db.Collection("users").FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return UserIdentity{}, nil
+	}
+	if err != nil {
+		return UserIdentity{}, fmt.Errorf("failed to read user %s: %v", userID, err)
+	}
+	return UserIdentity{GithubID: user.GithubID, Gmail: user.Gmail}, nil
+}
+
+// checkAccess decides whether a caller may read a file, the way the backend
+// does
+func checkAccess(ctx context.Context, caller Principal, file *FileManifest) error {
+	if file.IsPublic {
+		return nil
+	}
+	if caller.UserID == "" {
+		return ErrLoginRequired
+	}
+	if caller.UserID == file.Owner {
+		return nil
+	}
+
+	var user *UserIdentity
+	for _, s := range file.SharedWith {
+		if s.UserID != "" && s.UserID == caller.UserID {
+			return nil
+		}
+		if s.GithubID == "" && s.Gmail == "" {
+			continue
+		}
+		if user == nil {
+			u, err := Manifests.User(ctx, caller.UserID)
+			if err != nil {
+				return err
+			}
+			user = &u
+		}
+		if (s.GithubID != "" && s.GithubID == user.GithubID) || (s.Gmail != "" && s.Gmail == user.Gmail) {
+			return nil
+		}
+	}
+	return ErrAccessDenied
+}
+
+// recordedDomainPattern matches the dedup domains the upload service names
+var recordedDomainPattern = regexp.MustCompile(`^((org|user)-[A-Za-z0-9_-]{1,64})?$`)
+
+// fileDomain is the dedup domain a file's chunks were uploaded to, the one
+// recorded with its recipe, so every caller allowed to read the file finds
+// them: other organisations it is shared with and anonymous callers of public
+// files too. Recipes from before the domain was recorded fall back to the
+// owner's domain in per-user mode and to the caller's in per-org mode, where
+// the owner's organisation is not known.
+func fileDomain(caller Principal, file *FileManifest) (string, error) {
+	if file.Domain != nil {
+		if !recordedDomainPattern.MatchString(*file.Domain) {
+			return "", fmt.Errorf("invalid dedup domain %q recorded for file %s", *file.Domain, file.FileID)
+		}
+		return *file.Domain, nil
+	}
+	if dedupDomainMode == DomainUser {
+		return principalDomain(Principal{UserID: file.Owner})
+	}
+	return principalDomain(caller)
+}
+
+// Download is a version of a file a caller may read, planned as range reads
+type Download struct {
+	File *FileManifest
+	Plan map[string][]ChunkRange
+	Size int64  // content length
+	ETag string // quoted, derived from the recipe
+
+	// Chunks are the file's chunks in order and Offsets where each starts in
+	// the file. Offsets are summed from the chunk sizes in the index, which
+	// are what a download returns, rather than taken from the recipe.
+	Chunks  []ChunkMeta
+	Offsets []int64
+}
+
+// openFile resolves a version of a file for a caller and plans its download
+func openFile(caller Principal, fileID string, version int) (*Download, error) {
+	file, err := Manifests.File(ctx, fileID, version)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAccess(ctx, caller, file); err != nil {
+		return nil, err
+	}
+	domain, err := fileDomain(caller, file)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrAccessDenied, err)
+	}
+
+	shas := make([]string, len(file.Chunks))
+	recipe := sha256.New()
+	for i, c := range file.Chunks {
+		shas[i] = c.SHA
+		recipe.Write([]byte(c.SHA))
+	}
+	metas, err := FetchChunkMetadata(Index, domain, shas)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch chunk metadata: %v", err)
+	}
+	if len(metas) != len(shas) {
+		return nil, fmt.Errorf("%d of %d chunks of file %s are missing from the index", len(shas)-len(metas), len(shas), fileID)
+	}
+
+	var size int64
+	offsets := make([]int64, len(metas))
+	for i, m := range metas {
+		offsets[i] = size
+		size += int64(contentSize(m))
+	}
+	return &Download{
+		File:    file,
+		Plan:    OrganizeAndSortChunks(metas),
+		Size:    size,
+		ETag:    `"` + hex.EncodeToString(recipe.Sum(nil)[:16]) + `"`,
+		Chunks:  metas,
+		Offsets: offsets,
+	}, nil
+}
+
+// downloadStatus is the HTTP status a failed openFile is answered with
+func downloadStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrFileNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrLoginRequired):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrAccessDenied):
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
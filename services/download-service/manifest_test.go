@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestFileDomain(t *testing.T) {
+	defer func(mode string) { dedupDomainMode = mode }(dedupDomainMode)
+
+	recorded := func(domain string) *string { return &domain }
+	owner := "64b7f0c2a1e4d3b2c1a09f8e"
+	member := Principal{UserID: "bob", OrgID: "acme"}
+	outsider := Principal{UserID: "carol", OrgID: "globex"}
+	anonymous := Principal{}
+
+	tests := []struct {
+		name   string
+		mode   string
+		domain *string
+		caller Principal
+		want   string
+		ok     bool
+	}{
+		{"global", DomainGlobal, recorded(""), anonymous, "", true},
+		{"org, same org", DomainOrg, recorded("org-acme"), member, "org-acme", true},
+		{"org, shared across orgs", DomainOrg, recorded("org-acme"), outsider, "org-acme", true},
+		{"org, public without a token", DomainOrg, recorded("org-acme"), anonymous, "org-acme", true},
+		{"user, uploaded by a collaborator", DomainUser, recorded("user-bob"), outsider, "user-bob", true},
+		{"mode changed after upload", DomainOrg, recorded(""), member, "", true},
+		{"invalid recorded domain", DomainOrg, recorded("org-acme/../x"), member, "", false},
+		{"legacy user recipe uses the owner", DomainUser, nil, outsider, "user-" + owner, true},
+		{"legacy org recipe uses the caller", DomainOrg, nil, outsider, "org-globex", true},
+		{"legacy org recipe without a caller", DomainOrg, nil, anonymous, "", false},
+		{"legacy global recipe", DomainGlobal, nil, anonymous, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dedupDomainMode = tt.mode
+			file := &FileManifest{FileID: "f", Owner: owner, Domain: tt.domain}
+			got, err := fileDomain(tt.caller, file)
+			if tt.ok != (err == nil) {
+				t.Fatalf("got error %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("domain is %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
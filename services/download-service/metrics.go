@@ -0,0 +1,42 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+	"os"
+)
+
+// Counters are published through expvar on /debug/vars of the admin listener
+var (
+	// fetchWaitMicros is the time range reads spent queued for a slot, and
+	// fetchWaits counts them by the smallest of fetchWaitBuckets they waited
+	// at most (inf for longer)
+	fetchesStarted  = expvar.NewInt("download_fetches")
+	fetchWaitMicros = expvar.NewInt("download_fetch_wait_us")
+	fetchWaits      = expvar.NewMap("download_fetch_waits")
+
+	fetchesInFlight = expvar.NewInt("download_fetches_in_flight")
+	fetchesQueued   = expvar.NewInt("download_fetches_queued")
+)
+
+// defaultAdminAddr only accepts connections from the same host
+const defaultAdminAddr = "127.0.0.1:3101"
+
+// StartAdminServer serves /debug/vars on ADMIN_ADDR. expvar also publishes
+// the command line and memory stats, so it is kept off the public listener.
+func StartAdminServer() {
+	addr := os.Getenv("ADMIN_ADDR")
+	if addr == "" {
+		addr = defaultAdminAddr
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /debug/vars", expvar.Handler())
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Fatalf("Admin server failed: %v", err)
+		}
+	}()
+	log.Printf("Serving metrics on http://%s/debug/vars", addr)
+}
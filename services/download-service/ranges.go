@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Range requests only read the chunks a range covers. Chunks stored raw are
+// cut down to the requested bytes before they are fetched; compressed or
+// encrypted chunks have to be fetched and decoded whole and are trimmed
+// afterwards. The chunks are then merged into pack range reads by
+// OrganizeAndSortChunks like those of a whole file.
+
+// maxRanges caps the ranges one request may ask for; requests for more get
+// the whole file
+const maxRanges = 32
+
+// byteRange is the inclusive range [Start, End] of a file
+type byteRange struct {
+	Start int64
+	End   int64
+}
+
+func (r byteRange) length() int64 {
+	return r.End - r.Start + 1
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.Start, r.End, size)
+}
+
+var errNoOverlap = errors.New("requested range not satisfiable")
+
+// parseRange parses a Range header for a file of size bytes. Headers that do
+// not parse, or that ask for more than the file, are ignored and give no
+// ranges; errNoOverlap means none of the ranges is inside the file.
+func parseRange(header string, size int64) ([]byteRange, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return nil, nil
+	}
+
+	var ranges []byteRange
+	var total int64
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(part, "-")
+		if !ok {
+			return nil, nil
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+
+		var r byteRange
+		if first == "" {
+			// The last n bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, nil
+			}
+			r = byteRange{Start: max(size-n, 0), End: size - 1}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, nil
+			}
+			r = byteRange{Start: start, End: size - 1}
+			if last != "" {
+				end, err := strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, nil
+				}
+				r.End = min(end, size-1)
+			}
+		}
+		if r.Start >= size || r.End < r.Start {
+			continue
+		}
+		ranges = append(ranges, r)
+		total += r.length()
+	}
+
+	if len(ranges) == 0 {
+		return nil, errNoOverlap
+	}
+	if len(ranges) > maxRanges || total > size {
+		return nil, nil
+	}
+	return ranges, nil
+}
+
+// isRaw reports whether a chunk is stored as it is, so any part of it can be
+// fetched on its own
+func isRaw(meta ChunkMeta) bool {
+	return meta.Codec == "" && meta.KeyID == ""
+}
+
+// planRange plans the download of part of a file
+func (d *Download) planRange(r byteRange) map[string][]ChunkRange {
+	chunkEnd := func(i int) int64 {
+		return d.Offsets[i] + int64(contentSize(d.Chunks[i]))
+	}
+	first := sort.Search(len(d.Chunks), func(i int) bool { return chunkEnd(i) > r.Start })
+	last := sort.Search(len(d.Chunks), func(i int) bool { return d.Offsets[i] > r.End }) - 1
+
+	metas := append([]ChunkMeta(nil), d.Chunks[first:last+1]...)
+	skip := int(r.Start - d.Offsets[first])
+	drop := int(chunkEnd(last) - 1 - r.End)
+
+	head, tail := &metas[0], &metas[len(metas)-1]
+	if drop > 0 && isRaw(*tail) {
+		tail.End -= drop
+		tail.Size = tail.End - tail.Start + 1
+		drop = 0
+	}
+	if skip > 0 && isRaw(*head) {
+		head.Start += skip
+		head.Size = head.End - head.Start + 1
+		skip = 0
+	}
+
+	plan := OrganizeAndSortChunks(metas)
+	for _, ranges := range plan {
+		for i := range ranges {
+			members := ranges[i].Members
+			if members[0].No == head.No {
+				ranges[i].Skip = skip
+			}
+			if members[len(members)-1].No == tail.No {
+				ranges[i].Drop = drop
+			}
+		}
+	}
+	return plan
+}
+
+// rangesHeader is the part header of a range in a multipart/byteranges body
+func rangesHeader(r byteRange, contentType string, size int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Type":  {contentType},
+		"Content-Range": {r.contentRange(size)},
+	}
+}
+
+// multipartSize is the length of the multipart/byteranges body for ranges
+func multipartSize(ranges []byteRange, contentType string, size int64, boundary string) int64 {
+	var w countingWriter
+	mw := multipart.NewWriter(&w)
+	mw.SetBoundary(boundary)
+	for _, r := range ranges {
+		mw.CreatePart(rangesHeader(r, contentType, size))
+		w += countingWriter(r.length())
+	}
+	mw.Close()
+	return int64(w)
+}
+
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+// lazyWriter sends the status with the first byte of the body, so a download
+// that fails before anything was read can still be answered with an error
+type lazyWriter struct {
+	w       http.ResponseWriter
+	status  int
+	started bool
+}
+
+func (l *lazyWriter) Write(p []byte) (int, error) {
+	if !l.started {
+		l.started = true
+		l.w.WriteHeader(l.status)
+	}
+	return l.w.Write(p)
+}
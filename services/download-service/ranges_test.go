@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	const size = 1000
+	many := "bytes=" + strings.Repeat("0-0,", maxRanges) + "0-0"
+
+	tests := []struct {
+		name   string
+		header string
+		size   int64
+		want   []byteRange
+		err    error
+	}{
+		{"first bytes", "bytes=0-99", size, []byteRange{{0, 99}}, nil},
+		{"single byte", "bytes=5-5", size, []byteRange{{5, 5}}, nil},
+		{"open ended", "bytes=900-", size, []byteRange{{900, 999}}, nil},
+		{"suffix", "bytes=-100", size, []byteRange{{900, 999}}, nil},
+		{"suffix longer than the file", "bytes=-2000", size, []byteRange{{0, 999}}, nil},
+		{"end past the file", "bytes=990-2000", size, []byteRange{{990, 999}}, nil},
+		{"multiple ranges", "bytes=0-9, 20-29,-5", size, []byteRange{{0, 9}, {20, 29}, {995, 999}}, nil},
+		{"empty parts", "bytes=0-9,,", size, []byteRange{{0, 9}}, nil},
+		{"unsatisfiable part dropped", "bytes=0-9,1000-", size, []byteRange{{0, 9}}, nil},
+		{"start at the end", "bytes=1000-", size, nil, errNoOverlap},
+		{"all unsatisfiable", "bytes=1000-1005, 2000-", size, nil, errNoOverlap},
+		{"empty suffix", "bytes=-0", size, nil, errNoOverlap},
+		{"empty file", "bytes=0-", 0, nil, errNoOverlap},
+		{"other unit", "items=0-9", size, nil, nil},
+		{"no dash", "bytes=10", size, nil, nil},
+		{"not a number", "bytes=a-9", size, nil, nil},
+		{"negative start", "bytes=-5-9", size, nil, nil},
+		{"end before start", "bytes=5-2", size, nil, nil},
+		{"more than the file", "bytes=0-999,0-999", size, nil, nil},
+		{"too many ranges", many, size, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRange(tt.header, tt.size)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ranges %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// testDownload stores a file of five chunks in two packs, raw and gzipped
+// ones mixed, and plans its download
+func testDownload(t *testing.T) (*Download, []byte) {
+	t.Helper()
+	type chunk struct {
+		pack string
+		size int
+		gzip bool
+	}
+	chunks := []chunk{{"a", 100, false}, {"a", 200, true}, {"a", 50, false}, {"b", 300, false}, {"b", 150, true}}
+
+	packs := map[string][]byte{}
+	var content []byte
+	d := &Download{File: &FileManifest{}}
+	for i, c := range chunks {
+		data := []byte(strings.Repeat(fmt.Sprintf("<chunk %d>", i), c.size)[:c.size])
+		content = append(content, data...)
+
+		stored := data
+		meta := ChunkMeta{Filename: c.pack, No: i, SHA: fmt.Sprintf("%064x", i)}
+		if c.gzip {
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			zw.Write(data)
+			zw.Close()
+			stored = buf.Bytes()
+			meta.Codec, meta.Size = "gzip", c.size
+		}
+		meta.Start = len(packs[c.pack])
+		meta.End = meta.Start + len(stored) - 1
+		packs[c.pack] = append(packs[c.pack], stored...)
+
+		d.File.Chunks = append(d.File.Chunks, ChunkData{ChunkNo: i + 1, SHA: meta.SHA})
+		d.Chunks = append(d.Chunks, meta)
+		d.Offsets = append(d.Offsets, d.Size)
+		d.Size += int64(c.size)
+	}
+
+	store := NewMemoryBlobStore()
+	for key, data := range packs {
+		store.Put(ctx, key, bytes.NewReader(data))
+	}
+	Blobs = store
+	d.Plan = OrganizeAndSortChunks(d.Chunks)
+	return d, content
+}
+
+func TestPlanRange(t *testing.T) {
+	defer func(blobs BlobStore, fetches *FetchScheduler) { Blobs, Fetches = blobs, fetches }(Blobs, Fetches)
+	Fetches = NewFetchScheduler(4, 2)
+	d, content := testDownload(t)
+	gz1 := d.Chunks[1].End - d.Chunks[1].Start + 1
+	gz4 := d.Chunks[4].End - d.Chunks[4].Start + 1
+
+	tests := []struct {
+		name    string
+		r       byteRange
+		fetched int // stored bytes read
+	}{
+		{"whole file", byteRange{0, d.Size - 1}, 100 + gz1 + 50 + 300 + gz4},
+		{"first byte", byteRange{0, 0}, 1},
+		{"last byte", byteRange{d.Size - 1, d.Size - 1}, gz4},
+		{"inside a raw chunk", byteRange{10, 19}, 10},
+		{"inside a compressed chunk", byteRange{110, 120}, gz1},
+		{"exactly a compressed chunk", byteRange{100, 299}, gz1},
+		{"exactly a raw chunk", byteRange{350, 649}, 300},
+		{"raw ends around a compressed chunk", byteRange{90, 310}, 10 + gz1 + 11},
+		{"across packs", byteRange{340, 360}, 10 + 11},
+		{"raw tail into a compressed chunk", byteRange{600, 700}, 50 + gz4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := d.planRange(tt.r)
+
+			fetched := 0
+			for _, ranges := range plan {
+				for _, r := range ranges {
+					fetched += r.End - r.Start + 1
+				}
+			}
+			if fetched != tt.fetched {
+				t.Errorf("plan reads %d stored bytes, want %d", fetched, tt.fetched)
+			}
+
+			var out bytes.Buffer
+			if err := writePlan(context.Background(), &out, plan); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), content[tt.r.Start:tt.r.End+1]) {
+				t.Errorf("range reads %q, want %q", out.Bytes(), content[tt.r.Start:tt.r.End+1])
+			}
+		})
+	}
+}
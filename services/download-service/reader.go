@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+
+	"github.com/shrey209/NeuroStore/services/download-service/filereader"
+)
+
+// Random access to stored files lives in package filereader. These adapt a
+// planned Download to it: the recipe is the file's, chunks are located from
+// the index entries openFile already fetched, and range reads take fetch
+// slots like those of a streamed download.
+
+// NewFileReader opens a download for random access. ctx bounds every fetch
+// the reader makes.
+func NewFileReader(ctx context.Context, d *Download) (*filereader.Reader, error) {
+	return filereader.Open(ctx, d.File, downloadIndex{d}, scheduledBlobs{Fetches.NewGroup()})
+}
+
+// ChunkSHAs implements filereader.Recipe
+func (f *FileManifest) ChunkSHAs() []string {
+	shas := make([]string, len(f.Chunks))
+	for i, c := range f.Chunks {
+		shas[i] = c.SHA
+	}
+	return shas
+}
+
+// downloadIndex locates the chunks of a planned download
+type downloadIndex struct {
+	d *Download
+}
+
+func (x downloadIndex) Locate(ctx context.Context, shas []string) (map[string]filereader.Chunk, error) {
+	located := make(map[string]filereader.Chunk, len(x.d.Chunks))
+	for _, m := range x.d.Chunks {
+		c := filereader.Chunk{Pack: m.Filename, Start: int64(m.Start), End: int64(m.End), Size: contentSize(m)}
+		if !isRaw(m) {
+			c.Decode = func(stored []byte) ([]byte, error) { return decodeChunk(m, stored) }
+		}
+		located[m.SHA] = c
+	}
+	return located, nil
+}
+
+// scheduledBlobs reads from Blobs through a fetch group
+type scheduledBlobs struct {
+	group *FetchGroup
+}
+
+func (s scheduledBlobs) GetRange(ctx context.Context, key string, start, end int64) ([]byte, error) {
+	release, err := s.group.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return Blobs.GetRange(ctx, key, start, end)
+}
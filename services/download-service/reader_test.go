@@ -0,0 +1,21 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"testing/iotest"
+)
+
+func TestNewFileReader(t *testing.T) {
+	defer func(blobs BlobStore, fetches *FetchScheduler) { Blobs, Fetches = blobs, fetches }(Blobs, Fetches)
+	Fetches = NewFetchScheduler(4, 2)
+	d, content := testDownload(t)
+
+	r, err := NewFileReader(context.Background(), d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := iotest.TestReader(r, content); err != nil {
+		t.Error(err)
+	}
+}
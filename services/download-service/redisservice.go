@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisChunkIndex stores each chunk as a JSON ChunkMeta under its SHA
+type RedisChunkIndex struct {
+	rdb *redis.Client
+}
+
+func NewRedisChunkIndex(rdb *redis.Client) *RedisChunkIndex {
+	return &RedisChunkIndex{rdb: rdb}
+}
+
+func (r *RedisChunkIndex) Get(ctx context.Context, shas []string) (map[string]ChunkMeta, error) {
+	result := make(map[string]ChunkMeta, len(shas))
+	if len(shas) == 0 {
+		return result, nil
+	}
+
+	values, err := r.rdb.MGet(ctx, shas...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("redis MGet failed: %v", err)
+	}
+
+	for i, val := range values {
+		if val == nil {
+			continue
+		}
+		strVal, ok := val.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid type for key %s", shas[i])
+		}
+
+		var meta ChunkMeta
+		if err := json.Unmarshal([]byte(strVal), &meta); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal value for key %s: %v", shas[i], err)
+		}
+		result[shas[i]] = meta
+	}
+
+	return result, nil
+}
@@ -2,6 +2,10 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -11,19 +15,23 @@ import (
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/joho/godotenv"
 )
 
-var s3Client *s3.Client
-var bucketName string
+// S3BlobStore is the BlobStore backed by a single S3 bucket
+type S3BlobStore struct {
+	client *s3.Client
+	bucket string
+}
 
-func InitS3() {
+func InitS3() *S3BlobStore {
 	err := godotenv.Load()
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		log.Println("Warning: .env file not loaded, relying on actual environment variables")
 	}
 
-	bucketName = os.Getenv("BUCKET_NAME")
+	bucketName := os.Getenv("BUCKET_NAME")
 	region := os.Getenv("REGION")
 	accessKey := os.Getenv("ACCESS_KEY_ID")
 	secretKey := os.Getenv("SECRET_KEY")
@@ -36,20 +44,38 @@ func InitS3() {
 		log.Fatalf("Unable to load SDK config, %v", err)
 	}
 
-	s3Client = s3.NewFromConfig(customCfg)
+	return &S3BlobStore{client: s3.NewFromConfig(customCfg), bucket: bucketName}
+}
+
+func (s *S3BlobStore) Put(ctx context.Context, key string, body io.Reader) error {
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   body,
+		// S3 rejects the upload if the body does not match, and Head can
+		// report the checksum afterwards
+		ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload %s to S3: %v", key, err)
+	}
+	return nil
 }
 
-// FetchByteRangeFromS3 fetches a specific byte range from an S3 file
-func FetchByteRangeFromS3(fileKey string, start, end int) ([]byte, error) {
+// GetRange fetches a specific byte range from an S3 file
+func (s *S3BlobStore) GetRange(ctx context.Context, key string, start, end int64) ([]byte, error) {
 	rangeHeader := fmt.Sprintf("bytes=%d-%d", start, end)
-	fmt.Printf("🔍 Requesting range: %s\n", rangeHeader)
 
-	resp, err := s3Client.GetObject(context.TODO(), &s3.GetObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(fileKey),
+	resp, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
 		Range:  aws.String(rangeHeader),
 	})
 	if err != nil {
+		var nsk *types.NoSuchKey
+		if errors.As(err, &nsk) {
+			return nil, ErrBlobNotFound
+		}
 		return nil, fmt.Errorf("failed to fetch byte range from S3: %v", err)
 	}
 	defer resp.Body.Close()
@@ -61,3 +87,58 @@ func FetchByteRangeFromS3(fileKey string, start, end int) ([]byte, error) {
 
 	return data, nil
 }
+
+func (s *S3BlobStore) Head(ctx context.Context, key string) (BlobInfo, error) {
+	resp, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(s.bucket),
+		Key:          aws.String(key),
+		ChecksumMode: types.ChecksumModeEnabled,
+	})
+	if err != nil {
+		var nf *types.NotFound
+		if errors.As(err, &nf) {
+			return BlobInfo{}, ErrBlobNotFound
+		}
+		return BlobInfo{}, fmt.Errorf("failed to head %s: %v", key, err)
+	}
+	info := BlobInfo{Key: key, Size: aws.ToInt64(resp.ContentLength), Modified: aws.ToTime(resp.LastModified)}
+	if sum, err := base64.StdEncoding.DecodeString(aws.ToString(resp.ChecksumSHA256)); err == nil && len(sum) == sha256.Size {
+		info.SHA256 = hex.EncodeToString(sum)
+	}
+	return info, nil
+}
+
+func (s *S3BlobStore) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete %s: %v", key, err)
+	}
+	return nil
+}
+
+func (s *S3BlobStore) List(ctx context.Context, prefix string) ([]BlobInfo, error) {
+	var result []BlobInfo
+
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list bucket %s: %v", s.bucket, err)
+		}
+		for _, obj := range page.Contents {
+			result = append(result, BlobInfo{
+				Key:      aws.ToString(obj.Key),
+				Size:     aws.ToInt64(obj.Size),
+				Modified: aws.ToTime(obj.LastModified),
+			})
+		}
+	}
+
+	return result, nil
+}
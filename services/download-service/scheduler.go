@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// FetchScheduler runs the blob range reads of every download in the service,
+// at most limit at a time and at most perGroup for any one download. Each
+// download fetches through its own FetchGroup, and free slots are handed to
+// the groups with waiting fetches in turn, so a large download cannot starve
+// the small ones started after it.
+type FetchScheduler struct {
+	limit    int
+	perGroup int
+
+	lock    sync.Mutex
+	running int
+	waiting []*FetchGroup // groups with queued fetches, in turn order
+}
+
+// FetchGroup is the share of the scheduler one download fetches through
+type FetchGroup struct {
+	s       *FetchScheduler
+	running int
+	queue   []*fetchWaiter
+}
+
+type fetchWaiter struct {
+	ready  chan struct{}
+	queued time.Time
+}
+
+var Fetches *FetchScheduler
+
+// InitFetchScheduler reads FETCH_CONCURRENCY, the number of range reads the
+// service runs at once, and FETCH_PER_REQUEST, the number one download may run
+func InitFetchScheduler() {
+	limit := envPositiveInt("FETCH_CONCURRENCY", 64)
+	perGroup := envPositiveInt("FETCH_PER_REQUEST", 4)
+	Fetches = NewFetchScheduler(limit, min(perGroup, limit))
+	log.Printf("Fetching at most %d ranges at once, %d per download", limit, min(perGroup, limit))
+}
+
+func envPositiveInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		log.Fatalf("Invalid %s %q (expected a positive number)", name, v)
+	}
+	return n
+}
+
+func NewFetchScheduler(limit, perGroup int) *FetchScheduler {
+	return &FetchScheduler{limit: limit, perGroup: perGroup}
+}
+
+// NewGroup starts the share of a new download
+func (s *FetchScheduler) NewGroup() *FetchGroup {
+	return &FetchGroup{s: s}
+}
+
+// Acquire waits for a fetch slot. The returned release must be called once
+// the fetch is done.
+func (g *FetchGroup) Acquire(ctx context.Context) (release func(), err error) {
+	s := g.s
+	s.lock.Lock()
+
+	// Free slots are handed out as soon as they appear, so with one free
+	// nobody who could take it is waiting
+	if s.running < s.limit && g.running < s.perGroup {
+		s.running++
+		g.running++
+		s.lock.Unlock()
+		recordFetchWait(0)
+		return g.release, nil
+	}
+
+	w := &fetchWaiter{ready: make(chan struct{}), queued: time.Now()}
+	if len(g.queue) == 0 {
+		s.waiting = append(s.waiting, g)
+	}
+	g.queue = append(g.queue, w)
+	fetchesQueued.Add(1)
+	s.lock.Unlock()
+
+	select {
+	case <-w.ready:
+		return g.release, nil
+	case <-ctx.Done():
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	select {
+	case <-w.ready:
+		// Granted while giving up; hand the slot on
+		g.s.releaseLocked(g)
+	default:
+		g.removeLocked(w)
+		fetchesQueued.Add(-1)
+	}
+	return nil, ctx.Err()
+}
+
+func (g *FetchGroup) release() {
+	g.s.lock.Lock()
+	defer g.s.lock.Unlock()
+	g.s.releaseLocked(g)
+}
+
+func (s *FetchScheduler) releaseLocked(g *FetchGroup) {
+	s.running--
+	g.running--
+	fetchesInFlight.Add(-1)
+	s.dispatchLocked()
+}
+
+// dispatchLocked hands free slots to waiting groups in turn. A group that
+// gets a slot goes to the back of the line.
+func (s *FetchScheduler) dispatchLocked() {
+	for s.running < s.limit {
+		i := 0
+		for i < len(s.waiting) && s.waiting[i].running >= s.perGroup {
+			i++
+		}
+		if i == len(s.waiting) {
+			return
+		}
+		g := s.waiting[i]
+		s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+
+		w := g.queue[0]
+		g.queue = g.queue[1:]
+		if len(g.queue) > 0 {
+			s.waiting = append(s.waiting, g)
+		}
+
+		s.running++
+		g.running++
+		fetchesQueued.Add(-1)
+		recordFetchWait(time.Since(w.queued))
+		close(w.ready)
+	}
+}
+
+func (g *FetchGroup) removeLocked(w *fetchWaiter) {
+	for i, q := range g.queue {
+		if q == w {
+			g.queue = append(g.queue[:i], g.queue[i+1:]...)
+			break
+		}
+	}
+	if len(g.queue) > 0 {
+		return
+	}
+	for i, q := range g.s.waiting {
+		if q == g {
+			g.s.waiting = append(g.s.waiting[:i], g.s.waiting[i+1:]...)
+			break
+		}
+	}
+}
+
+// fetchWaitBuckets are the upper bounds queue waits are counted under
+var fetchWaitBuckets = []time.Duration{time.Millisecond, 10 * time.Millisecond, 100 * time.Millisecond, time.Second, 10 * time.Second}
+
+// recordFetchWait counts a fetch that starts after waiting d
+func recordFetchWait(d time.Duration) {
+	fetchesStarted.Add(1)
+	fetchesInFlight.Add(1)
+	fetchWaitMicros.Add(d.Microseconds())
+
+	bucket := "inf"
+	for _, b := range fetchWaitBuckets {
+		if d <= b {
+			bucket = b.String()
+			break
+		}
+	}
+	fetchWaits.Add(bucket, 1)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type grant struct {
+	group   int
+	release func()
+}
+
+// accounted is how many fetches the scheduler is running or holding back
+func accounted(s *FetchScheduler) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	n := s.running
+	for _, g := range s.waiting {
+		n += len(g.queue)
+	}
+	return n
+}
+
+func TestFetchScheduler(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    int
+		perGroup int
+		requests []int // the download of each fetch, in the order they ask
+		want     []int // the download of each fetch, in the order they start
+	}{
+		{"under both limits", 4, 4, []int{0, 0, 1}, []int{0, 0, 1}},
+		{"global limit", 2, 2, []int{0, 0, 1, 1}, []int{0, 0, 1, 1}},
+		{"per-download limit leaves room for others", 4, 2, []int{0, 0, 0, 1}, []int{0, 0, 1, 0}},
+		{"downloads take turns", 2, 2, []int{0, 0, 0, 0, 0, 1, 1}, []int{0, 0, 0, 1, 0, 1, 0}},
+		{"three downloads take turns", 1, 1, []int{0, 0, 0, 1, 1, 2}, []int{0, 0, 1, 2, 0, 1}},
+		{"download at its limit is skipped", 3, 2, []int{1, 0, 0, 0, 2}, []int{1, 0, 0, 2, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewFetchScheduler(tt.limit, tt.perGroup)
+			groups := make([]*FetchGroup, 3)
+			for i := range groups {
+				groups[i] = s.NewGroup()
+			}
+			granted := make(chan grant)
+
+			// Ask one at a time so the queue order is the request order
+			var got []int
+			var held []grant
+			for i, g := range tt.requests {
+				queued := len(groups[g].queue)
+				go func() {
+					release, err := groups[g].Acquire(context.Background())
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					granted <- grant{g, release}
+				}()
+				for accounted(s) < i+1 {
+					time.Sleep(time.Millisecond)
+				}
+				s.lock.Lock()
+				started := len(groups[g].queue) == queued
+				s.lock.Unlock()
+				if started {
+					gr := <-granted
+					got = append(got, gr.group)
+					held = append(held, gr)
+				}
+			}
+
+			// Each finished fetch lets exactly one waiting fetch start
+			for len(got) < len(tt.requests) {
+				held[0].release()
+				held = held[1:]
+				select {
+				case gr := <-granted:
+					got = append(got, gr.group)
+					held = append(held, gr)
+				case <-time.After(time.Second):
+					t.Fatalf("no fetch started after a release; started %v", got)
+				}
+
+				perGroup := make(map[int]int)
+				for _, h := range held {
+					perGroup[h.group]++
+					if perGroup[h.group] > tt.perGroup {
+						t.Fatalf("download %d runs %d fetches, limit %d", h.group, perGroup[h.group], tt.perGroup)
+					}
+				}
+				if len(held) > tt.limit {
+					t.Fatalf("%d fetches running, limit %d", len(held), tt.limit)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("fetches started in order %v, want %v", got, tt.want)
+			}
+
+			for _, h := range held {
+				h.release()
+			}
+			if s.running != 0 || len(s.waiting) != 0 {
+				t.Errorf("%d running and %d downloads waiting after every release", s.running, len(s.waiting))
+			}
+		})
+	}
+}
+
+func TestFetchSchedulerCancel(t *testing.T) {
+	s := NewFetchScheduler(1, 1)
+	first, waiter := s.NewGroup(), s.NewGroup()
+	release, err := first.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := waiter.Acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+	if n := accounted(s); n != 1 {
+		t.Fatalf("%d fetches accounted after giving up, want 1", n)
+	}
+
+	// The slot goes to nobody once the waiter has left
+	release()
+	if n := accounted(s); n != 0 {
+		t.Fatalf("%d fetches accounted after release, want 0", n)
+	}
+	release, err = waiter.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
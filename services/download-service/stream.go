@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// Downloads fetch their ranges concurrently but hand them on strictly in file
+// order. Ranges are started in file order and at most downloadWindow of them
+// are in flight or waiting to be emitted at once, so a download holds at most
+// downloadWindow ranges in memory whatever the size of the file. A range is
+// never larger than the run of chunks it covers in one pack. How many of the
+// ranges in flight are actually being read is up to the fetch scheduler.
+var downloadWindow = 8
+
+// InitStreaming reads DOWNLOAD_WINDOW, the number of ranges a download may
+// fetch ahead of the one it is emitting
+func InitStreaming() {
+	v := os.Getenv("DOWNLOAD_WINDOW")
+	if v == "" {
+		return
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		log.Fatalf("Invalid DOWNLOAD_WINDOW %q (expected a positive number)", v)
+	}
+	downloadWindow = n
+}
+
+type rangeResult struct {
+	data []byte
+	err  error
+}
+
+// streamRanges fetches the ranges of a download plan and calls emit with each
+// range's content in file order. The first failed fetch or emit stops the
+// stream and is returned; ranges still in flight are abandoned.
+func streamRanges(ctx context.Context, plan map[string][]ChunkRange, emit func(no int, data []byte) error) error {
+	type job struct {
+		filename string
+		r        ChunkRange
+	}
+	var jobs []job
+	for filename, ranges := range plan {
+		for _, r := range ranges {
+			jobs = append(jobs, job{filename, r})
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].r.No < jobs[j].r.No
+	})
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	group := Fetches.NewGroup()
+
+	// pending holds one result channel per started range, in file order. Its
+	// buffer plus the range being waited on make up the window.
+	pending := make(chan chan rangeResult, downloadWindow-1)
+	go func() {
+		defer close(pending)
+		for _, j := range jobs {
+			done := make(chan rangeResult, 1)
+			select {
+			case pending <- done:
+			case <-ctx.Done():
+				return
+			}
+			go func(j job) {
+				release, err := group.Acquire(ctx)
+				if err != nil {
+					done <- rangeResult{nil, err}
+					return
+				}
+				defer release()
+				data, err := fetchRange(ctx, j.filename, j.r)
+				done <- rangeResult{data, err}
+			}(j)
+		}
+	}()
+
+	for i := 0; i < len(jobs); i++ {
+		var done chan rangeResult
+		select {
+		case done = <-pending:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		res := <-done
+		if res.err != nil {
+			return fmt.Errorf("failed to fetch chunk %d: %v", jobs[i].r.No, res.err)
+		}
+		if err := emit(jobs[i].r.No, res.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestAuthenticate(t *testing.T) {
+	defer func(keyfunc jwt.Keyfunc, methods []string, disabled bool) {
+		jwtKeyfunc, jwtMethods, authDisabled = keyfunc, methods, disabled
+	}(jwtKeyfunc, jwtMethods, authDisabled)
+
+	secret := []byte("test secret")
+	sign := func(claims jwt.MapClaims, key []byte) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	valid := sign(jwt.MapClaims{"id": "alice", "org": "acme", "exp": time.Now().Add(time.Hour).Unix()}, secret)
+
+	tests := []struct {
+		name     string
+		keyed    bool // JWT_SECRET is set
+		disabled bool // AUTH_DISABLED=1
+		token    string
+		want     Principal
+		ok       bool
+	}{
+		{"no key fails closed", false, false, "", Principal{}, false},
+		{"no key ignores tokens", false, false, valid, Principal{}, false},
+		{"auth disabled trusts headers", false, true, "", Principal{UserID: "mallory", OrgID: "other"}, true},
+		{"valid token", true, false, valid, Principal{UserID: "alice", OrgID: "acme"}, true},
+		{"headers are ignored", true, false, "", Principal{}, false},
+		{"sub claim", true, false, sign(jwt.MapClaims{"sub": "bob", "exp": time.Now().Add(time.Hour).Unix()}, secret), Principal{UserID: "bob"}, true},
+		{"expired", true, false, sign(jwt.MapClaims{"id": "alice", "exp": time.Now().Add(-time.Hour).Unix()}, secret), Principal{}, false},
+		{"no expiry", true, false, sign(jwt.MapClaims{"id": "alice"}, secret), Principal{}, false},
+		{"wrong key", true, false, sign(jwt.MapClaims{"id": "alice", "exp": time.Now().Add(time.Hour).Unix()}, []byte("other")), Principal{}, false},
+		{"no user", true, false, sign(jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix()}, secret), Principal{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jwtKeyfunc, jwtMethods, authDisabled = nil, nil, tt.disabled
+			if tt.keyed {
+				jwtKeyfunc = func(*jwt.Token) (interface{}, error) { return secret, nil }
+				jwtMethods = []string{"HS256"}
+			}
+
+			r := httptest.NewRequest("GET", "/ws/upload", nil)
+			r.Header.Set("X-User-ID", "mallory")
+			r.Header.Set("X-Org-ID", "other")
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+
+			p, err := authenticate(r)
+			if tt.ok != (err == nil) {
+				t.Fatalf("got error %v", err)
+			}
+			if p != tt.want {
+				t.Errorf("caller is %+v, want %+v", p, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// ErrBlobNotFound is returned by a BlobStore when the requested key does not exist
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobInfo describes a stored object. Head fills in SHA256 (hex) when the
+// backend can report it; List leaves it empty.
+type BlobInfo struct {
+	Key      string
+	Size     int64
+	SHA256   string
+	Modified time.Time
+}
+
+// BlobStore is where chunk packs live. GetRange uses an inclusive end offset,
+// the same convention as the HTTP Range header and ChunkMeta.
+type BlobStore interface {
+	Put(ctx context.Context, key string, body io.Reader) error
+	GetRange(ctx context.Context, key string, start, end int64) ([]byte, error)
+	Head(ctx context.Context, key string) (BlobInfo, error)
+	Delete(ctx context.Context, key string) error
+	List(ctx context.Context, prefix string) ([]BlobInfo, error)
+}
+
+var Blobs BlobStore
+
+// InitBlobStore picks the backend from BLOB_STORE (s3, local or memory).
+// s3 stays the default so existing deployments keep working unchanged.
+func InitBlobStore() {
+	backend := os.Getenv("BLOB_STORE")
+
+	switch backend {
+	case "", "s3":
+		Blobs = InitS3()
+	case "local":
+		dir := os.Getenv("BLOB_DIR")
+		if dir == "" {
+			dir = "blobs"
+		}
+		store, err := NewLocalBlobStore(dir)
+		if err != nil {
+			log.Fatalf("Failed to open local blob store: %v", err)
+		}
+		Blobs = store
+		log.Printf("Using local blob store at %s", dir)
+	case "memory":
+		Blobs = NewMemoryBlobStore()
+		log.Println("Using in-memory blob store, packs will not survive a restart")
+	default:
+		log.Fatalf("Unknown BLOB_STORE %q (expected s3, local or memory)", backend)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+)
+
+// Content defined chunking, kept byte-for-byte compatible with
+// chunk-wasm/cdc.c so chunks cut here dedup against browser uploads. Any
+// change to the constants or the rolling hash must be made in both places.
+const (
+	MinChunk  = 2048
+	AvgChunk  = 8192
+	MaxChunk  = 16384
+	chunkMask = AvgChunk - 1
+)
+
+// Block mirrors the JSON produced by get_blocks_json in cdc.c. Offsets are
+// inclusive and chunk numbers start at 1.
+type Block struct {
+	Start   int    `json:"start"`
+	End     int    `json:"end"`
+	ChunkNo int    `json:"chunk_no"`
+	SHA     string `json:"sha"`
+}
+
+// Chunker cuts a byte stream into content defined chunks. Write may be called
+// with any split of the input; boundaries only depend on the bytes themselves.
+// Unlike the wasm build there is no MAX_BLOCKS cap on the number of chunks.
+type Chunker struct {
+	emit        func(b Block, data []byte) error
+	cur         []byte
+	rollingHash uint64
+	byteIndex   int
+	chunkStart  int
+	totalChunks int
+}
+
+// NewChunker calls emit once per finished chunk. data is only valid for the
+// duration of the call.
+func NewChunker(emit func(b Block, data []byte) error) *Chunker {
+	return &Chunker{
+		emit: emit,
+		cur:  make([]byte, 0, MaxChunk),
+	}
+}
+
+func (c *Chunker) slide(b byte) {
+	c.rollingHash = ((c.rollingHash << 5) + c.rollingHash + uint64(b)) % 0xFFFFFFFF
+}
+
+func (c *Chunker) Write(p []byte) (int, error) {
+	for _, b := range p {
+		c.slide(b)
+		c.cur = append(c.cur, b)
+		c.byteIndex++
+
+		isBoundary := c.rollingHash&chunkMask == 0
+		if (len(c.cur) >= MinChunk && isBoundary) || len(c.cur) >= MaxChunk {
+			if err := c.cut(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// Close emits whatever is left as the final, possibly short, chunk
+func (c *Chunker) Close() error {
+	if len(c.cur) == 0 {
+		return nil
+	}
+	return c.cut()
+}
+
+func (c *Chunker) cut() error {
+	sum := sha256.Sum256(c.cur)
+	block := Block{
+		Start:   c.chunkStart,
+		End:     c.byteIndex - 1,
+		ChunkNo: c.totalChunks + 1,
+		SHA:     hex.EncodeToString(sum[:]),
+	}
+
+	err := c.emit(block, c.cur)
+
+	c.cur = c.cur[:0]
+	c.rollingHash = 0
+	c.chunkStart = c.byteIndex
+	c.totalChunks++
+	return err
+}
+
+// ChunkReader chunks everything in r
+func ChunkReader(r io.Reader, emit func(b Block, data []byte) error) error {
+	c := NewChunker(emit)
+	if _, err := io.Copy(c, r); err != nil {
+		return err
+	}
+	return c.Close()
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// cdc_vectors.json is produced by running chunk-wasm/cdc.c over the inputs
+// below; see testdata/gencdc. Every split of the input into writes must give
+// the same blocks.
+type cdcVector struct {
+	Name   string  `json:"name"`
+	Kind   string  `json:"kind"`
+	Seed   uint32  `json:"seed"`
+	Length int     `json:"length"`
+	Blocks []Block `json:"blocks"`
+}
+
+// vectorInput builds the input of a vector the way gencdc/main.c does
+func vectorInput(v cdcVector) []byte {
+	const text = "the quick brown fox jumps over the lazy dog\n"
+	buf := make([]byte, v.Length)
+	x := v.Seed
+	for i := range buf {
+		switch v.Kind {
+		case "random":
+			x ^= x << 13
+			x ^= x >> 17
+			x ^= x << 5
+			buf[i] = byte(x)
+		case "text":
+			buf[i] = text[i%len(text)]
+		}
+	}
+	return buf
+}
+
+// vectorSplits returns the write sizes to feed an input in, by name
+func vectorSplits(v cdcVector) map[string][]int {
+	n := v.Length
+	fixed := func(step int) []int {
+		var sizes []int
+		for left := n; left > 0; left -= min(step, left) {
+			sizes = append(sizes, min(step, left))
+		}
+		return sizes
+	}
+	// Writes ending exactly on, just before and just after each boundary
+	atBoundaries := func(shift int) []int {
+		var sizes []int
+		prev := 0
+		for _, b := range v.Blocks {
+			at := min(max(b.End+1+shift, prev), n)
+			sizes = append(sizes, at-prev)
+			prev = at
+		}
+		return append(sizes, n-prev)
+	}
+	rng := rand.New(rand.NewSource(int64(n)))
+	var random []int
+	for left := n; left > 0; {
+		s := min(1+rng.Intn(3*MaxChunk), left)
+		random = append(random, s)
+		left -= s
+	}
+
+	return map[string][]int{
+		"whole":             {n},
+		"bytes":             fixed(1),
+		"7 bytes":           fixed(7),
+		"min chunk":         fixed(MinChunk),
+		"max chunk + 1":     fixed(MaxChunk + 1),
+		"at boundaries":     atBoundaries(0),
+		"before boundaries": atBoundaries(-1),
+		"after boundaries":  atBoundaries(1),
+		"random":            random,
+	}
+}
+
+func TestChunkerMatchesCDC(t *testing.T) {
+	raw, err := os.ReadFile("testdata/cdc_vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors []cdcVector
+	if err := json.Unmarshal(raw, &vectors); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range vectors {
+		input := vectorInput(v)
+		for name, sizes := range vectorSplits(v) {
+			t.Run(v.Name+"/"+name, func(t *testing.T) {
+				var got []Block
+				c := NewChunker(func(b Block, data []byte) error {
+					if len(data) != b.End-b.Start+1 {
+						t.Errorf("chunk %d has %d bytes, want %d", b.ChunkNo, len(data), b.End-b.Start+1)
+					}
+					got = append(got, b)
+					return nil
+				})
+				off := 0
+				for _, s := range sizes {
+					if _, err := c.Write(input[off : off+s]); err != nil {
+						t.Fatal(err)
+					}
+					off += s
+				}
+				if err := c.Close(); err != nil {
+					t.Fatal(err)
+				}
+
+				if len(got) != len(v.Blocks) {
+					t.Fatalf("got %d blocks, want %d", len(got), len(v.Blocks))
+				}
+				for i := range got {
+					if got[i] != v.Blocks[i] {
+						t.Errorf("block %d is %+v, want %+v", i, got[i], v.Blocks[i])
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// ChunkIndex maps a chunk SHA to the pack and byte range holding its data.
+// Exists splits shas into the ones already stored and the ones that still
+// need uploading; Get skips shas that are not in the index. DeleteUnseen
+// deletes the entries last seen at or before cutoff (unix seconds), checking
+// and deleting each at once so a concurrent Touch is never lost, and returns
+// the ones it deleted. Touch refreshes
+// ChunkMeta.Seen on existing entries (at most once per touchInterval) and
+// never recreates an entry that has been deleted. Repoint moves the entries
+// that still live in pack from to where moves says they are stored now
+// (pack, range, codec, size and key), keeping No and Seen, and returns how
+// many moved.
+//
+// Outside the global dedup domain the "shas" are chunk keys, the SHA
+// prefixed with its domain (see chunkKey).
+type ChunkIndex interface {
+	Exists(ctx context.Context, shas []string) (existing []string, missing []string, err error)
+	Get(ctx context.Context, shas []string) (map[string]ChunkMeta, error)
+	PutBatch(ctx context.Context, metas map[string]ChunkMeta) error
+	DeleteUnseen(ctx context.Context, shas []string, cutoff int64) (map[string]ChunkMeta, error)
+	Iterate(ctx context.Context, fn func(sha string, meta ChunkMeta) error) error
+	Touch(ctx context.Context, shas []string) error
+	Repoint(ctx context.Context, from string, moves map[string]ChunkMeta) (int, error)
+}
+
+// touchInterval bounds how often Touch rewrites an entry. The GC grace period
+// must be much longer than this.
+const touchInterval = time.Hour
+
+var Index ChunkIndex
+
+// InitChunkIndex picks the backend from CHUNK_INDEX (redis or memory). The
+// memory index is persisted to CHUNK_INDEX_FILE when it is set, which is
+// enough for a single node deployment without Redis.
+func InitChunkIndex() {
+	backend := os.Getenv("CHUNK_INDEX")
+
+	switch backend {
+	case "", "redis":
+		InitRedis()
+		Index = NewRedisChunkIndex(RedisClient)
+	case "memory":
+		path := os.Getenv("CHUNK_INDEX_FILE")
+		idx, err := NewMemoryChunkIndex(path)
+		if err != nil {
+			log.Fatalf("Failed to load chunk index: %v", err)
+		}
+		Index = idx
+		if path == "" {
+			log.Println("Using in-memory chunk index, metadata will not survive a restart")
+		} else {
+			log.Printf("Using embedded chunk index persisted to %s", path)
+		}
+	default:
+		log.Fatalf("Unknown CHUNK_INDEX %q (expected redis or memory)", backend)
+	}
+}
+
+func isSHA256Hex(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// chunkKey is the index key of a chunk in a dedup domain: the bare SHA in the
+// global domain, "<domain>/<sha>" in any other
+func chunkKey(domain, sha string) string {
+	if domain == "" {
+		return sha
+	}
+	return domain + "/" + sha
+}
+
+// splitChunkKey reverses chunkKey; ok is false for keys that are not chunk
+// keys at all
+func splitChunkKey(key string) (domain, sha string, ok bool) {
+	if i := strings.LastIndexByte(key, '/'); i >= 0 {
+		domain, sha = key[:i], key[i+1:]
+		return domain, sha, domain != "" && isSHA256Hex(sha)
+	}
+	return "", key, isSHA256Hex(key)
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+// lockFile is a no-op where flock is not available; only one process may
+// then use a CHUNK_INDEX_FILE at a time
+func lockFile(path string) (func(), error) {
+	return func() {}, nil
+}
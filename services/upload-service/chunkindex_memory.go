@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryChunkIndex is an embedded ChunkIndex. With a path set, every write
+// rewrites a JSON snapshot of the whole index and other processes sharing the
+// file pick up changes on their next read. Writes hold a lock on the file, so
+// commands such as compact can run next to the service.
+type MemoryChunkIndex struct {
+	lock    sync.RWMutex
+	metas   map[string]ChunkMeta
+	path    string
+	modTime time.Time
+}
+
+func NewMemoryChunkIndex(path string) (*MemoryChunkIndex, error) {
+	idx := &MemoryChunkIndex{metas: make(map[string]ChunkMeta), path: path}
+	if path == "" {
+		return idx, nil
+	}
+	if err := idx.reload(); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// reload reads the snapshot if it changed since we last looked. Callers must
+// hold the write lock.
+func (m *MemoryChunkIndex) reload() error {
+	if m.path == "" {
+		return nil
+	}
+
+	st, err := os.Stat(m.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if st.ModTime().Equal(m.modTime) {
+		return nil
+	}
+	return m.load(st)
+}
+
+// load reads the snapshot whatever its modification time. Callers must hold
+// the write lock.
+func (m *MemoryChunkIndex) load(st fs.FileInfo) error {
+	data, err := os.ReadFile(m.path)
+	if err != nil {
+		return err
+	}
+	metas := make(map[string]ChunkMeta)
+	if err := json.Unmarshal(data, &metas); err != nil {
+		return fmt.Errorf("failed to parse chunk index %s: %v", m.path, err)
+	}
+
+	m.metas = metas
+	m.modTime = st.ModTime()
+	return nil
+}
+
+// persist must be called with the write lock held
+func (m *MemoryChunkIndex) persist() error {
+	if m.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(m.metas)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(m.path), ".chunkindex-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), m.path); err != nil {
+		return err
+	}
+
+	st, err := os.Stat(m.path)
+	if err != nil {
+		return err
+	}
+	m.modTime = st.ModTime()
+	return nil
+}
+
+func (m *MemoryChunkIndex) Exists(ctx context.Context, shas []string) (existing []string, missing []string, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err := m.reload(); err != nil {
+		return nil, nil, err
+	}
+
+	for _, sha := range shas {
+		if _, ok := m.metas[sha]; ok {
+			existing = append(existing, sha)
+		} else {
+			missing = append(missing, sha)
+		}
+	}
+	return existing, missing, nil
+}
+
+func (m *MemoryChunkIndex) Get(ctx context.Context, shas []string) (map[string]ChunkMeta, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err := m.reload(); err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]ChunkMeta, len(shas))
+	for _, sha := range shas {
+		if meta, ok := m.metas[sha]; ok {
+			result[sha] = meta
+		}
+	}
+	return result, nil
+}
+
+// update applies a change to the latest snapshot and persists it if fn
+// reports that anything changed. With a path set, the snapshot file stays
+// locked from reload to persist so a write from another process sharing it,
+// such as the compact command, is never overwritten with a stale copy.
+func (m *MemoryChunkIndex) update(fn func() bool) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.path != "" {
+		unlock, err := lockFile(m.path + ".lock")
+		if err != nil {
+			return fmt.Errorf("failed to lock chunk index %s: %v", m.path, err)
+		}
+		defer unlock()
+
+		// Modification times are too coarse to tell two quick writes apart,
+		// so writes always start from the file
+		st, err := os.Stat(m.path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if err == nil {
+			if err := m.load(st); err != nil {
+				return err
+			}
+		}
+	}
+	if !fn() {
+		return nil
+	}
+	return m.persist()
+}
+
+func (m *MemoryChunkIndex) PutBatch(ctx context.Context, metas map[string]ChunkMeta) error {
+	return m.update(func() bool {
+		for sha, meta := range metas {
+			m.metas[sha] = meta
+		}
+		return true
+	})
+}
+
+// DeleteUnseen checks Seen on the entries as they are now, like the Redis
+// deleteUnseenScript, so it cannot undo a concurrent Touch
+func (m *MemoryChunkIndex) DeleteUnseen(ctx context.Context, shas []string, cutoff int64) (map[string]ChunkMeta, error) {
+	deleted := make(map[string]ChunkMeta)
+	err := m.update(func() bool {
+		for _, sha := range shas {
+			meta, ok := m.metas[sha]
+			if !ok || meta.Seen > cutoff {
+				continue
+			}
+			delete(m.metas, sha)
+			deleted[sha] = meta
+		}
+		return len(deleted) > 0
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+// Touch only changes Seen on the entries as they are now, like the Redis
+// touchScript, so it cannot undo a concurrent Repoint
+func (m *MemoryChunkIndex) Touch(ctx context.Context, shas []string) error {
+	now := time.Now().Unix()
+	return m.update(func() bool {
+		changed := false
+		for _, sha := range shas {
+			meta, ok := m.metas[sha]
+			if !ok || now-meta.Seen < int64(touchInterval/time.Second) {
+				continue
+			}
+			meta.Seen = now
+			m.metas[sha] = meta
+			changed = true
+		}
+		return changed
+	})
+}
+
+func (m *MemoryChunkIndex) Repoint(ctx context.Context, from string, moves map[string]ChunkMeta) (int, error) {
+	moved := 0
+	err := m.update(func() bool {
+		for sha, to := range moves {
+			meta, ok := m.metas[sha]
+			if !ok || meta.Filename != from {
+				continue
+			}
+			to.No, to.Seen = meta.No, meta.Seen
+			m.metas[sha] = to
+			moved++
+		}
+		return moved > 0
+	})
+	if err != nil {
+		return 0, err
+	}
+	return moved, nil
+}
+
+// Iterate walks a sorted copy of the index so fn is free to call back into it
+func (m *MemoryChunkIndex) Iterate(ctx context.Context, fn func(sha string, meta ChunkMeta) error) error {
+	m.lock.Lock()
+	if err := m.reload(); err != nil {
+		m.lock.Unlock()
+		return err
+	}
+	shas := make([]string, 0, len(m.metas))
+	snapshot := make(map[string]ChunkMeta, len(m.metas))
+	for sha, meta := range m.metas {
+		shas = append(shas, sha)
+		snapshot[sha] = meta
+	}
+	m.lock.Unlock()
+
+	sort.Strings(shas)
+	for _, sha := range shas {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(sha, snapshot[sha]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// testIndexes returns a fresh index of each backend, twice: the second of
+// each pair shares the first's storage like another process would
+func testIndexes(t *testing.T) map[string][2]ChunkIndex {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "index.json")
+	m1, err := NewMemoryChunkIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2, err := NewMemoryChunkIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mr := miniredis.RunT(t)
+	r1 := NewRedisChunkIndex(redis.NewClient(&redis.Options{Addr: mr.Addr()}))
+	r2 := NewRedisChunkIndex(redis.NewClient(&redis.Options{Addr: mr.Addr()}))
+
+	return map[string][2]ChunkIndex{
+		"memory": {m1, m2},
+		"redis":  {r1, r2},
+	}
+}
+
+func testSHA(i int) string {
+	return fmt.Sprintf("%064x", i)
+}
+
+func TestChunkIndexTouch(t *testing.T) {
+	recent := time.Now().Unix() - 60
+	for name, idx := range testIndexes(t) {
+		t.Run(name, func(t *testing.T) {
+			index := idx[0]
+			err := index.PutBatch(ctx, map[string]ChunkMeta{
+				testSHA(1): {Filename: "pack-a", Start: 5, End: 9, No: 1, Codec: "zstd", Size: 20, Seen: 1},
+				testSHA(2): {Filename: "pack-a", Start: 10, End: 19, No: 2, Seen: recent},
+				testSHA(3): {Filename: "pack-a", Start: 20, End: 29, No: 3, Seen: 1},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := index.DeleteUnseen(ctx, []string{testSHA(3)}, 1); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := index.Touch(ctx, []string{testSHA(1), testSHA(2), testSHA(3), testSHA(4)}); err != nil {
+				t.Fatal(err)
+			}
+			metas, err := index.Get(ctx, []string{testSHA(1), testSHA(2), testSHA(3), testSHA(4)})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(metas) != 2 {
+				t.Fatalf("index has %d of the entries, want 2: Touch must not create entries", len(metas))
+			}
+			touched := metas[testSHA(1)]
+			if touched.Seen < time.Now().Unix()-5 {
+				t.Errorf("stale entry was not touched: seen %d", touched.Seen)
+			}
+			touched.Seen = 1
+			if want := (ChunkMeta{Filename: "pack-a", Start: 5, End: 9, No: 1, Codec: "zstd", Size: 20, Seen: 1}); touched != want {
+				t.Errorf("touch changed more than seen: %+v", touched)
+			}
+			if metas[testSHA(2)].Seen != recent {
+				t.Errorf("entry seen within touchInterval was rewritten: seen %d", metas[testSHA(2)].Seen)
+			}
+		})
+	}
+}
+
+func TestChunkIndexRepoint(t *testing.T) {
+	for name, idx := range testIndexes(t) {
+		t.Run(name, func(t *testing.T) {
+			index := idx[0]
+			err := index.PutBatch(ctx, map[string]ChunkMeta{
+				testSHA(1): {Filename: "old", Start: 5, End: 9, No: 1, Codec: "zstd", Size: 20, Seen: 100},
+				testSHA(2): {Filename: "elsewhere", Start: 5, End: 9, No: 2, Seen: 100},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			to := ChunkMeta{Filename: "new", Start: 50, End: 59, Size: 10, KeyID: "k1"}
+			moved, err := index.Repoint(ctx, "old", map[string]ChunkMeta{testSHA(1): to, testSHA(2): to, testSHA(3): to})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if moved != 1 {
+				t.Errorf("moved %d entries, want 1", moved)
+			}
+
+			metas, err := index.Get(ctx, []string{testSHA(1), testSHA(2), testSHA(3)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]ChunkMeta{
+				testSHA(1): {Filename: "new", Start: 50, End: 59, No: 1, Size: 10, KeyID: "k1", Seen: 100},
+				testSHA(2): {Filename: "elsewhere", Start: 5, End: 9, No: 2, Seen: 100},
+			}
+			if len(metas) != len(want) {
+				t.Fatalf("index has %v", metas)
+			}
+			for sha, w := range want {
+				if metas[sha] != w {
+					t.Errorf("%s is %+v, want %+v", sha[60:], metas[sha], w)
+				}
+			}
+		})
+	}
+}
+
+// Touch from the upload path and Repoint from compaction run at the same
+// time, possibly in different processes; no repoint may be lost
+func TestChunkIndexTouchRacesRepoint(t *testing.T) {
+	const n = 100
+	for name, idx := range testIndexes(t) {
+		t.Run(name, func(t *testing.T) {
+			uploads, compaction := idx[0], idx[1]
+			metas := make(map[string]ChunkMeta, n)
+			for i := 0; i < n; i++ {
+				metas[testSHA(i)] = ChunkMeta{Filename: "old", Start: i, End: i, No: i, Seen: 1}
+			}
+			if err := uploads.PutBatch(ctx, metas); err != nil {
+				t.Fatal(err)
+			}
+
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < n; i++ {
+					if err := uploads.Touch(context.Background(), []string{testSHA(i)}); err != nil {
+						t.Error(err)
+					}
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for i := 0; i < n; i++ {
+					to := ChunkMeta{Filename: "new", Start: i, End: i}
+					if _, err := compaction.Repoint(context.Background(), "old", map[string]ChunkMeta{testSHA(i): to}); err != nil {
+						t.Error(err)
+					}
+				}
+			}()
+			wg.Wait()
+
+			shas := make([]string, 0, n)
+			for sha := range metas {
+				shas = append(shas, sha)
+			}
+			got, err := uploads.Get(ctx, shas)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for sha, meta := range got {
+				if meta.Filename != "new" {
+					t.Errorf("%s points at %s after being repointed", sha[60:], meta.Filename)
+				}
+				if meta.Seen == 1 {
+					t.Errorf("%s was not touched", sha[60:])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Chunks are compressed one by one before they go into a pack, so any chunk
+// can still be fetched and decoded on its own with a single ranged read. The
+// codec is recorded both in the pack index and in ChunkMeta.
+const (
+	CodecGzip uint8 = 1
+	CodecZstd uint8 = 2
+)
+
+// minCompressionSaving is the fraction of a chunk compression must save to be
+// kept; media and archives rarely get there and are stored as they are
+const minCompressionSaving = 0.05
+
+// maxDecodedChunk caps what a single record may decode to
+const maxDecodedChunk = 64 << 20
+
+var (
+	chunkCodec  = CodecZstd
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+func init() {
+	var err error
+	zstdEncoder, err = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		panic(err)
+	}
+	zstdDecoder, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(maxDecodedChunk))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// InitChunkCodec picks the codec from CHUNK_CODEC (zstd, gzip or none)
+func InitChunkCodec() {
+	switch v := os.Getenv("CHUNK_CODEC"); v {
+	case "", "zstd":
+		chunkCodec = CodecZstd
+	case "gzip":
+		chunkCodec = CodecGzip
+	case "none":
+		chunkCodec = CodecNone
+	default:
+		log.Fatalf("Unknown CHUNK_CODEC %q (expected zstd, gzip or none)", v)
+	}
+	log.Printf("Compressing chunks with %s", codecName(chunkCodec))
+}
+
+// codecName is how a codec is spelled in ChunkMeta
+func codecName(codec uint8) string {
+	switch codec {
+	case CodecGzip:
+		return "gzip"
+	case CodecZstd:
+		return "zstd"
+	default:
+		return ""
+	}
+}
+
+// codecByName reverses codecName; unknown names map to a codec decodeChunk
+// refuses
+func codecByName(name string) uint8 {
+	switch name {
+	case "":
+		return CodecNone
+	case "gzip":
+		return CodecGzip
+	case "zstd":
+		return CodecZstd
+	default:
+		return 255
+	}
+}
+
+// compressChunk returns what to store for a chunk and the codec it is stored
+// with, falling back to the raw bytes when compression does not pay off
+func compressChunk(raw []byte) ([]byte, uint8) {
+	var out []byte
+
+	switch chunkCodec {
+	case CodecZstd:
+		out = zstdEncoder.EncodeAll(raw, nil)
+	case CodecGzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(raw)
+		if err := zw.Close(); err != nil {
+			return raw, CodecNone
+		}
+		out = buf.Bytes()
+	default:
+		return raw, CodecNone
+	}
+
+	if float64(len(out)) > float64(len(raw))*(1-minCompressionSaving) {
+		return raw, CodecNone
+	}
+	compressedChunks.Add(codecName(chunkCodec), 1)
+	return out, chunkCodec
+}
+
+// decodeChunk reverses compressChunk
+func decodeChunk(codec uint8, stored []byte, rawLength int) ([]byte, error) {
+	var out []byte
+	var err error
+
+	switch codec {
+	case CodecNone:
+		out = stored
+	case CodecZstd:
+		out, err = zstdDecoder.DecodeAll(stored, make([]byte, 0, rawLength))
+	case CodecGzip:
+		var zr *gzip.Reader
+		zr, err = gzip.NewReader(bytes.NewReader(stored))
+		if err == nil {
+			out, err = io.ReadAll(io.LimitReader(zr, maxDecodedChunk))
+		}
+	default:
+		return nil, fmt.Errorf("unknown codec %d", codec)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s chunk: %v", codecName(codec), err)
+	}
+	if len(out) != rawLength {
+		return nil, fmt.Errorf("%s chunk decoded to %d bytes, expected %d", codecName(codec), len(out), rawLength)
+	}
+	return out, nil
+}
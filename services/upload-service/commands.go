@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+// runCommand runs an admin subcommand instead of the server, e.g.
+//
+//	./app requeue-dead-letters
+func runCommand(args []string) {
+	switch args[0] {
+	case "requeue-dead-letters":
+		requeueDeadLetters()
+	case "verify-packs":
+		verifyPacks()
+	case "rebuild-index":
+		rebuildIndex(args[1:])
+	case "gc":
+		gcCommand(args[1:])
+	case "compact":
+		compactCommand(args[1:])
+	case "rotate-keys":
+		rotateKeysCommand(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+		fmt.Fprintln(os.Stderr, "commands:")
+		fmt.Fprintln(os.Stderr, "  requeue-dead-letters  move dead-lettered chunks back into the ingest WAL")
+		fmt.Fprintln(os.Stderr, "  verify-packs          check the checksums of every pack in the blob store")
+		fmt.Fprintln(os.Stderr, "  rebuild-index         repopulate the chunk index from pack indexes (-dry-run)")
+		fmt.Fprintln(os.Stderr, "  gc                    delete chunks no file references any more (-dry-run)")
+		fmt.Fprintln(os.Stderr, "  compact               rewrite mostly dead packs (-dry-run, -threshold)")
+		fmt.Fprintln(os.Stderr, "  rotate-keys           re-encrypt chunks not under the current key (-dry-run, -new-key)")
+		os.Exit(2)
+	}
+}
+
+// requeueDeadLetters must run while the upload service is stopped; the chunks
+// are picked up from the WAL on its next start
+func requeueDeadLetters() {
+	InitDeadLetters()
+
+	dir := ingestWALDir()
+	wal, err := OpenIngestLog(dir)
+	if err != nil {
+		log.Fatalf("Failed to open ingest WAL: %v", err)
+	}
+
+	n, err := DeadLetters.Requeue(wal)
+	if err != nil {
+		log.Fatalf("Requeued %d chunks before failing: %v", n, err)
+	}
+	log.Printf("Requeued %d dead-lettered chunks into %s", n, dir)
+}
+
+// verifyPacks downloads every pack and checks it against its own index. It
+// exits non-zero if any pack is damaged.
+func verifyPacks() {
+	InitBlobStore()
+	InitKeys()
+
+	packs, err := listPacks(ctx)
+	if err != nil {
+		log.Fatalf("Failed to list packs: %v", err)
+	}
+
+	bad := 0
+	for _, info := range packs {
+		data, err := Blobs.GetRange(ctx, info.Key, 0, info.Size-1)
+		if err == nil {
+			_, err = VerifyPack(data)
+		}
+		if err != nil {
+			bad++
+			fmt.Printf("%s: %v\n", info.Key, err)
+		}
+	}
+
+	fmt.Printf("Verified %d packs, %d damaged\n", len(packs), bad)
+	if bad > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+)
+
+// A pack is committed in two steps: store it and verify what landed in the
+// blob store, then publish its chunk metadata. Metadata is never written for
+// a pack that is not known to be stored, otherwise uploads would dedup
+// against chunks that do not exist.
+const (
+	commitAttempts = 5
+	commitBackoff  = time.Second
+)
+
+// retry runs fn until it succeeds, backing off exponentially between attempts
+func retry(what string, fn func() error) error {
+	delay := commitBackoff
+	var err error
+
+	for attempt := 1; attempt <= commitAttempts; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if attempt == commitAttempts {
+			break
+		}
+		commitRetries.Add(1)
+		log.Printf("[Commit] %s failed (attempt %d/%d), retrying in %s: %v", what, attempt, commitAttempts, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+
+	return fmt.Errorf("%s failed after %d attempts: %v", what, commitAttempts, err)
+}
+
+// storePack uploads a pack and checks the stored object has the right size
+// and checksum
+func storePack(key string, pack []byte) error {
+	sum := sha256.Sum256(pack)
+	want := hex.EncodeToString(sum[:])
+
+	return retry("upload of "+key, func() error {
+		if err := Blobs.Put(ctx, key, bytes.NewReader(pack)); err != nil {
+			return err
+		}
+
+		info, err := Blobs.Head(ctx, key)
+		if err != nil {
+			return fmt.Errorf("failed to verify pack: %v", err)
+		}
+		if info.Size != int64(len(pack)) {
+			return fmt.Errorf("stored pack is %d bytes, expected %d", info.Size, len(pack))
+		}
+
+		// Not every backend reports a checksum, read the pack back instead
+		if info.SHA256 == "" {
+			data, err := Blobs.GetRange(ctx, key, 0, int64(len(pack))-1)
+			if err != nil {
+				return fmt.Errorf("failed to read back pack: %v", err)
+			}
+			got := sha256.Sum256(data)
+			info.SHA256 = hex.EncodeToString(got[:])
+		}
+		if info.SHA256 != want {
+			return fmt.Errorf("stored pack checksum %s does not match %s", info.SHA256, want)
+		}
+		return nil
+	})
+}
+
+// commitPack stores the pack and only then publishes its chunk metadata
+func commitPack(key string, pack []byte, metas map[string]ChunkMeta) error {
+	if err := storePack(key, pack); err != nil {
+		return err
+	}
+
+	err := retry("metadata publish for "+key, func() error {
+		return Index.PutBatch(ctx, metas)
+	})
+	if err != nil {
+		// Nothing points at the pack, so it is safe to drop
+		if delErr := Blobs.Delete(ctx, key); delErr != nil {
+			log.Printf("[Commit] Failed to remove orphaned pack %s: %v", key, delErr)
+		}
+		return err
+	}
+
+	committedPacks.Add(1)
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// DeadLetterStore keeps the chunks of tasks that could not be committed after
+// every retry. Each entry is an ingest WAL segment (<id>.wal) next to a text
+// file with the error (<id>.txt). They stay there until an operator runs the
+// requeue-dead-letters command.
+type DeadLetterStore struct {
+	dir string
+}
+
+var DeadLetters *DeadLetterStore
+
+func InitDeadLetters() {
+	dir := os.Getenv("DEAD_LETTER_DIR")
+	if dir == "" {
+		dir = "dead-letters"
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatalf("Failed to create dead letter dir: %v", err)
+	}
+	DeadLetters = &DeadLetterStore{dir: dir}
+}
+
+// Add durably stores the chunks so the caller can release them from the WAL
+func (d *DeadLetterStore) Add(chunks []Chunk, cause error) error {
+	segment, err := encodeSegment(chunks)
+	if err != nil {
+		return err
+	}
+
+	id := uuid.New().String()
+	if err := writeFileSync(filepath.Join(d.dir, id+".wal"), segment); err != nil {
+		return fmt.Errorf("failed to write dead letter %s: %v", id, err)
+	}
+	if err := os.WriteFile(filepath.Join(d.dir, id+".txt"), []byte(cause.Error()+"\n"), 0644); err != nil {
+		log.Printf("[DeadLetter] Failed to record cause for %s: %v", id, err)
+	}
+
+	deadLetteredChunks.Add(int64(len(chunks)))
+	log.Printf("[DeadLetter] Stored %d chunks as %s: %v", len(chunks), id, cause)
+	return nil
+}
+
+// Requeue moves every dead letter back into the WAL and returns how many
+// chunks were moved
+func (d *DeadLetterStore) Requeue(wal *IngestLog) (int, error) {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".wal")
+		if !ok {
+			continue
+		}
+
+		path := filepath.Join(d.dir, e.Name())
+		chunks, err := readSegment(path)
+		if err != nil {
+			return total, fmt.Errorf("failed to read dead letter %s: %v", id, err)
+		}
+		if err := wal.Append(chunks); err != nil {
+			return total, err
+		}
+
+		os.Remove(path)
+		os.Remove(filepath.Join(d.dir, id+".txt"))
+		total += len(chunks)
+	}
+	return total, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Dedup domains decide who deduplicates against whom. In the global domain,
+// the default, all uploads share one index, so a client whose chunk is not
+// requested learns that somebody already stored it. With DEDUP_DOMAIN=org or
+// user every organisation or user gets its own index namespace and its own
+// packs, and a chunk is only deduplicated against copies in the same domain.
+//
+// Domains are named "org-<id>" or "user-<id>". Their index keys are
+// "<domain>/<sha>" (see chunkKey) and their packs are stored under
+// domains/<domain>/, so per-tenant bucket policies can apply to them. The
+// global domain keeps bare SHAs and top level packs. Changing the mode does
+// not move chunks that are already stored.
+//
+// The domain comes from the caller's identity, see auth.go.
+const (
+	DomainGlobal = "global"
+	DomainOrg    = "org"
+	DomainUser   = "user"
+)
+
+var dedupDomainMode = DomainGlobal
+
+var domainIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// InitDedupDomain reads DEDUP_DOMAIN (global, org or user)
+func InitDedupDomain() {
+	switch v := os.Getenv("DEDUP_DOMAIN"); v {
+	case "", DomainGlobal:
+		dedupDomainMode = DomainGlobal
+	case DomainOrg, DomainUser:
+		dedupDomainMode = v
+		log.Printf("Deduplicating per %s", v)
+	default:
+		log.Fatalf("Invalid DEDUP_DOMAIN %q (expected global, org or user)", v)
+	}
+}
+
+// principalDomain returns the dedup domain of a caller, "" for the global one
+func principalDomain(p Principal) (string, error) {
+	var id string
+	switch dedupDomainMode {
+	case DomainOrg:
+		id = p.OrgID
+	case DomainUser:
+		id = p.UserID
+	default:
+		return "", nil
+	}
+
+	if !domainIDPattern.MatchString(id) {
+		return "", fmt.Errorf("missing or invalid %s id", dedupDomainMode)
+	}
+	return dedupDomainMode + "-" + id, nil
+}
+
+const domainPackPrefix = "domains/"
+
+// newPackKey names a new pack in a dedup domain
+func newPackKey(domain string) string {
+	key := fmt.Sprintf("chunk_set_%s.bin", uuid.New().String())
+	if domain == "" {
+		return key
+	}
+	return domainPackPrefix + domain + "/" + key
+}
+
+// packDomain is the dedup domain a pack belongs to
+func packDomain(key string) string {
+	if !strings.HasPrefix(key, domainPackPrefix) {
+		return ""
+	}
+	return path.Dir(strings.TrimPrefix(key, domainPackPrefix))
+}
+
+// listPacks lists the packs of every dedup domain
+func listPacks(ctx context.Context) ([]BlobInfo, error) {
+	var packs []BlobInfo
+	for _, prefix := range []string{"chunk_set_", domainPackPrefix} {
+		infos, err := Blobs.List(ctx, prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			if strings.HasPrefix(path.Base(info.Key), "chunk_set_") {
+				packs = append(packs, info)
+			}
+		}
+	}
+	return packs, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+)
+
+// Binary chunk frames are used on /ws/upload when the client asks for the
+// chunkFrameProtocol websocket subprotocol. They carry the raw chunk bytes
+// instead of base64 JSON:
+//
+//	offset  size  field
+//	0       1     frame version (1)
+//	1       4     chunk_no, big endian
+//	5       32    sha256 of the data
+//	37      4     data length, big endian
+//	41      n     chunk data
+//
+// Text messages (legacy JSON chunks and "__EOF__") are still accepted on a
+// binary connection.
+const (
+	chunkFrameProtocol = "neurostore.chunks.v1"
+	chunkFrameVersion  = 1
+	chunkFrameHeader   = 41
+)
+
+func decodeChunkFrame(frame []byte) (Chunk, error) {
+	if len(frame) < chunkFrameHeader {
+		return Chunk{}, fmt.Errorf("frame too short: %d bytes", len(frame))
+	}
+
+	chunk := Chunk{
+		ChunkNo: int(binary.BigEndian.Uint32(frame[1:5])),
+		SHA:     hex.EncodeToString(frame[5:37]),
+	}
+	if frame[0] != chunkFrameVersion {
+		return chunk, fmt.Errorf("unsupported frame version %d", frame[0])
+	}
+
+	length := binary.BigEndian.Uint32(frame[37:41])
+	data := frame[chunkFrameHeader:]
+	if uint32(len(data)) != length {
+		return chunk, fmt.Errorf("frame declares %d data bytes but carries %d", length, len(data))
+	}
+
+	chunk.Bytes = data
+	return chunk, nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// GC is mark and sweep. Every chunk listed by a file recipe is live in the
+// dedup domain the recipe records; any other index entry that has not been
+// packed or deduplicated against within the grace period is dead. Recipes
+// registered before the domain was recorded keep their SHAs live in every
+// domain.
+//
+// Dead index entries are deleted first, so from then on a client asking about
+// one is told to upload it again instead of deduplicating against bytes that
+// are about to go. A pack is only deleted once no index entry points into it
+// and it is older than the grace period, so a pack whose metadata is still
+// being published is never touched. Dead chunks in packs that still hold live
+// ones stay where they are until the pack is compacted.
+const (
+	defaultGCGrace = 48 * time.Hour
+	gcBatchSize    = 1000
+)
+
+type GCOptions struct {
+	Grace  time.Duration
+	DryRun bool
+}
+
+type GCReport struct {
+	Referenced   int
+	Scanned      int
+	DeadChunks   int
+	DeadBytes    int64
+	DeletedPacks int
+	FreedBytes   int64
+}
+
+func (r GCReport) String() string {
+	return fmt.Sprintf("%d chunks referenced, %d indexed: %d dead (%d bytes), %d packs deleted (%d bytes)",
+		r.Referenced, r.Scanned, r.DeadChunks, r.DeadBytes, r.DeletedPacks, r.FreedBytes)
+}
+
+func RunGC(ctx context.Context, opts GCOptions) (GCReport, error) {
+	var report GCReport
+	cutoff := time.Now().Add(-opts.Grace)
+
+	live := make(map[string]bool)         // chunk keys
+	liveAnywhere := make(map[string]bool) // SHAs of recipes without a domain
+	err := Recipes.ReferencedChunks(ctx, func(domain *string, sha string) {
+		if domain == nil {
+			liveAnywhere[sha] = true
+		} else {
+			live[chunkKey(*domain, sha)] = true
+		}
+	})
+	if err != nil {
+		return report, fmt.Errorf("failed to read file recipes: %v", err)
+	}
+	report.Referenced = len(live) + len(liveAnywhere)
+
+	livePacks := make(map[string]int)
+	var candidates []string
+	scanned := make(map[string]ChunkMeta)
+	err = Index.Iterate(ctx, func(key string, meta ChunkMeta) error {
+		report.Scanned++
+		_, sha, _ := splitChunkKey(key)
+		if live[key] || liveAnywhere[sha] || meta.Seen > cutoff.Unix() {
+			livePacks[meta.Filename]++
+		} else {
+			candidates = append(candidates, key)
+			scanned[key] = meta
+		}
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("failed to scan chunk index: %v", err)
+	}
+
+	// An empty mark almost always means GC is looking at the wrong database
+	if report.Referenced == 0 && len(candidates) > 0 {
+		return report, fmt.Errorf("no file recipe references any chunk, refusing to collect %d chunks (check MONGO_URI)", len(candidates))
+	}
+
+	for i := 0; i < len(candidates); i += gcBatchSize {
+		batch := candidates[i:min(i+gcBatchSize, len(candidates))]
+
+		if opts.DryRun {
+			for _, key := range batch {
+				meta := scanned[key]
+				report.DeadBytes += int64(meta.End - meta.Start + 1)
+			}
+			report.DeadChunks += len(batch)
+			continue
+		}
+
+		// A client may have deduplicated against one of these since the
+		// scan; the index only deletes the ones still unseen
+		dead, err := Index.DeleteUnseen(ctx, batch, cutoff.Unix())
+		if err != nil {
+			return report, fmt.Errorf("failed to delete dead chunks: %v", err)
+		}
+		for _, key := range batch {
+			meta, ok := dead[key]
+			if !ok {
+				livePacks[scanned[key].Filename]++
+				continue
+			}
+			report.DeadBytes += int64(meta.End - meta.Start + 1)
+		}
+		report.DeadChunks += len(dead)
+		gcChunksDeleted.Add(int64(len(dead)))
+	}
+
+	// Compaction deletes the packs it replaced itself, after they drain
+	retiring, err := retiringPacks()
+	if err != nil {
+		return report, err
+	}
+
+	packs, err := listPacks(ctx)
+	if err != nil {
+		return report, fmt.Errorf("failed to list packs: %v", err)
+	}
+	for _, info := range packs {
+		if livePacks[info.Key] > 0 || info.Modified.After(cutoff) || retiring[info.Key] {
+			continue
+		}
+		if !opts.DryRun {
+			if err := Blobs.Delete(ctx, info.Key); err != nil {
+				return report, fmt.Errorf("failed to delete pack %s: %v", info.Key, err)
+			}
+			gcPacksDeleted.Add(1)
+		}
+		report.DeletedPacks++
+		report.FreedBytes += info.Size
+	}
+
+	return report, nil
+}
+
+// touchChunks keeps chunks a client is deduplicating against out of GC's
+// reach for another grace period
+func touchChunks(domain string, shas []string) {
+	if len(shas) == 0 {
+		return
+	}
+	keys := make([]string, len(shas))
+	for i, sha := range shas {
+		keys[i] = chunkKey(domain, sha)
+	}
+	if err := Index.Touch(ctx, keys); err != nil {
+		log.Printf("[GC] Failed to touch %d chunks: %v", len(shas), err)
+	}
+}
+
+func gcGrace() time.Duration {
+	grace := defaultGCGrace
+	if v := os.Getenv("GC_GRACE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 2*touchInterval {
+			log.Fatalf("Invalid GC_GRACE %q, it must be a duration of at least %s", v, 2*touchInterval)
+		}
+		grace = d
+	}
+	return grace
+}
+
+// StartGCLoop runs GC in the background every GC_INTERVAL. It is off unless
+// GC_INTERVAL is set; only one upload service instance should enable it.
+func StartGCLoop() {
+	v := os.Getenv("GC_INTERVAL")
+	if v == "" {
+		return
+	}
+	interval, err := time.ParseDuration(v)
+	if err != nil || interval <= 0 {
+		log.Fatalf("Invalid GC_INTERVAL %q", v)
+	}
+
+	InitRecipeStore()
+	opts := GCOptions{Grace: gcGrace()}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			report, err := RunGC(ctx, opts)
+			gcRuns.Add(1)
+			if err != nil {
+				log.Printf("[GC] Run failed: %v", err)
+				continue
+			}
+			log.Printf("[GC] %s", report)
+		}
+	}()
+	log.Printf("GC runs every %s with a %s grace period", interval, opts.Grace)
+}
+
+func gcCommand(args []string) {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "report what would be deleted without deleting it")
+	fs.Parse(args)
+
+	InitChunkIndex()
+	InitBlobStore()
+	InitRecipeStore()
+
+	report, err := RunGC(ctx, GCOptions{Grace: gcGrace(), DryRun: *dryRun})
+	if err != nil {
+		log.Fatalf("GC failed: %v", err)
+	}
+	if *dryRun {
+		fmt.Printf("Dry run, nothing deleted: %s\n", report)
+		return
+	}
+	fmt.Println(report)
+}
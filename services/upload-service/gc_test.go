@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRecipes lists referenced chunks; a nil domain is a recipe from before
+// domains were recorded
+type testRecipes []struct {
+	domain *string
+	sha    string
+}
+
+func (r testRecipes) ReferencedChunks(ctx context.Context, fn func(domain *string, sha string)) error {
+	for _, c := range r {
+		fn(c.domain, c.sha)
+	}
+	return nil
+}
+
+func recorded(domain string) *string { return &domain }
+
+// touchAfterScan has another process touch a chunk once GC has scanned the
+// index, as a client deduplicating against it then would
+type touchAfterScan struct {
+	ChunkIndex
+	other ChunkIndex
+	key   string
+}
+
+func (x touchAfterScan) DeleteUnseen(ctx context.Context, shas []string, cutoff int64) (map[string]ChunkMeta, error) {
+	if err := x.other.Touch(ctx, []string{x.key}); err != nil {
+		return nil, err
+	}
+	return x.ChunkIndex.DeleteUnseen(ctx, shas, cutoff)
+}
+
+func TestGCKeepsChunkTouchedAfterScan(t *testing.T) {
+	defer func(index ChunkIndex, blobs BlobStore, recipes RecipeStore) {
+		Index, Blobs, Recipes = index, blobs, recipes
+	}(Index, Blobs, Recipes)
+	t.Setenv("COMPACT_JOURNAL", filepath.Join(t.TempDir(), "compaction.json"))
+
+	for name, idx := range testIndexes(t) {
+		t.Run(name, func(t *testing.T) {
+			err := idx[0].PutBatch(ctx, map[string]ChunkMeta{
+				testSHA(1): {Filename: "chunk_set_live", Start: 0, End: 9, Seen: 1},
+				testSHA(2): {Filename: "chunk_set_dead", Start: 0, End: 9, Seen: 1},
+				testSHA(3): {Filename: "chunk_set_touched", Start: 0, End: 9, Seen: 1},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			store := NewMemoryBlobStore()
+			for _, key := range []string{"chunk_set_live", "chunk_set_dead", "chunk_set_touched"} {
+				store.Put(ctx, key, strings.NewReader("0123456789"))
+				store.modified[key] = time.Now().Add(-2 * defaultGCGrace)
+			}
+			Index = touchAfterScan{ChunkIndex: idx[0], other: idx[1], key: testSHA(3)}
+			Blobs = store
+			Recipes = testRecipes{{recorded(""), testSHA(1)}}
+
+			report, err := RunGC(ctx, GCOptions{Grace: defaultGCGrace})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.DeadChunks != 1 || report.DeletedPacks != 1 {
+				t.Errorf("report %s, want 1 dead chunk and 1 pack deleted", report)
+			}
+
+			metas, err := idx[0].Get(ctx, []string{testSHA(1), testSHA(2), testSHA(3)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := metas[testSHA(3)]; !ok {
+				t.Error("chunk touched after the scan was deleted")
+			}
+			if _, ok := metas[testSHA(2)]; ok {
+				t.Error("dead chunk was kept")
+			}
+			if _, ok := metas[testSHA(1)]; !ok {
+				t.Error("referenced chunk was deleted")
+			}
+			if _, err := store.Head(ctx, "chunk_set_touched"); err != nil {
+				t.Errorf("pack of the touched chunk was deleted: %v", err)
+			}
+			if _, err := store.Head(ctx, "chunk_set_dead"); err == nil {
+				t.Error("dead pack was kept")
+			}
+		})
+	}
+}
+
+func TestGCMarksRecordedDomain(t *testing.T) {
+	defer func(index ChunkIndex, blobs BlobStore, recipes RecipeStore) {
+		Index, Blobs, Recipes = index, blobs, recipes
+	}(Index, Blobs, Recipes)
+	t.Setenv("COMPACT_JOURNAL", filepath.Join(t.TempDir(), "compaction.json"))
+
+	index, err := NewMemoryChunkIndex("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := make(map[string]ChunkMeta)
+	for _, domain := range []string{"", "org-a", "org-b"} {
+		for i := 1; i <= 3; i++ {
+			entries[chunkKey(domain, testSHA(i))] = ChunkMeta{Filename: "chunk_set_x", Start: 0, End: 9, Seen: 1}
+		}
+	}
+	if err := index.PutBatch(ctx, entries); err != nil {
+		t.Fatal(err)
+	}
+	Index, Blobs = index, NewMemoryBlobStore()
+	Recipes = testRecipes{
+		{recorded("org-a"), testSHA(1)},
+		{recorded(""), testSHA(2)},
+		{nil, testSHA(3)},
+	}
+
+	if _, err := RunGC(ctx, GCOptions{Grace: defaultGCGrace}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		domain string
+		sha    int
+		live   bool
+	}{
+		{"org-a", 1, true},
+		{"org-b", 1, false},
+		{"", 1, false},
+		{"", 2, true},
+		{"org-a", 2, false},
+		{"", 3, true},
+		{"org-a", 3, true},
+		{"org-b", 3, true},
+	}
+	for _, tt := range tests {
+		key := chunkKey(tt.domain, testSHA(tt.sha))
+		metas, err := index.Get(ctx, []string{key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := metas[key]; ok != tt.live {
+			t.Errorf("chunk %d in domain %q kept: %v, want %v", tt.sha, tt.domain, ok, tt.live)
+		}
+	}
+}
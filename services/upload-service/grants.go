@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// OwnershipGrants remembers which chunks each user has shown they hold, by
+// uploading them or by answering a challenge, so recipe registration can
+// refuse recipes naming chunks the user never had (see handleCheckRecipe).
+// Keys are chunk keys (see chunkKey). A grant lasts ownershipGrantTTL, which
+// only has to cover the time between an upload and registering its recipe.
+type OwnershipGrants interface {
+	Grant(ctx context.Context, user string, keys []string) error
+	// Missing returns the keys the user holds no grant for, in order
+	Missing(ctx context.Context, user string, keys []string) ([]string, error)
+}
+
+const ownershipGrantTTL = 24 * time.Hour
+
+var Grants OwnershipGrants
+
+// InitOwnershipGrants keeps grants in Redis when the chunk index is there, so
+// every instance sees them, and in memory otherwise
+func InitOwnershipGrants() {
+	if RedisClient != nil {
+		Grants = NewRedisOwnershipGrants(RedisClient)
+		return
+	}
+	Grants = NewMemoryOwnershipGrants()
+	log.Println("Keeping ownership grants in memory, recipes must be registered with the instance that took the upload")
+}
+
+// RedisOwnershipGrants keeps a sorted set per user under "ownership:<user>",
+// scored by when each grant expires
+type RedisOwnershipGrants struct {
+	rdb *redis.Client
+}
+
+func NewRedisOwnershipGrants(rdb *redis.Client) *RedisOwnershipGrants {
+	return &RedisOwnershipGrants{rdb: rdb}
+}
+
+func grantsKey(user string) string {
+	return "ownership:" + user
+}
+
+func (r *RedisOwnershipGrants) Grant(ctx context.Context, user string, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	now := time.Now()
+	expires := float64(now.Add(ownershipGrantTTL).Unix())
+	members := make([]redis.Z, len(keys))
+	for i, key := range keys {
+		members[i] = redis.Z{Score: expires, Member: key}
+	}
+
+	key := grantsKey(user)
+	pipe := r.rdb.TxPipeline()
+	pipe.ZAdd(ctx, key, members...)
+	pipe.ZRemRangeByScore(ctx, key, "-inf", fmt.Sprint(now.Unix()))
+	pipe.Expire(ctx, key, ownershipGrantTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to record ownership grants: %v", err)
+	}
+	return nil
+}
+
+func (r *RedisOwnershipGrants) Missing(ctx context.Context, user string, keys []string) ([]string, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	scores, err := r.rdb.ZMScore(ctx, grantsKey(user), keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ownership grants: %v", err)
+	}
+
+	now := float64(time.Now().Unix())
+	var missing []string
+	for i, score := range scores {
+		// Keys without a grant come back with a score of 0
+		if score <= now {
+			missing = append(missing, keys[i])
+		}
+	}
+	return missing, nil
+}
+
+// MemoryOwnershipGrants keeps grants in the process, for single instance
+// deployments
+type MemoryOwnershipGrants struct {
+	lock   sync.Mutex
+	grants map[string]map[string]time.Time // user → key → expiry
+}
+
+func NewMemoryOwnershipGrants() *MemoryOwnershipGrants {
+	return &MemoryOwnershipGrants{grants: make(map[string]map[string]time.Time)}
+}
+
+func (m *MemoryOwnershipGrants) Grant(ctx context.Context, user string, keys []string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := time.Now()
+	granted := m.grants[user]
+	if granted == nil {
+		granted = make(map[string]time.Time)
+		m.grants[user] = granted
+	}
+	for key, expires := range granted {
+		if !now.Before(expires) {
+			delete(granted, key)
+		}
+	}
+	for _, key := range keys {
+		granted[key] = now.Add(ownershipGrantTTL)
+	}
+	return nil
+}
+
+func (m *MemoryOwnershipGrants) Missing(ctx context.Context, user string, keys []string) ([]string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := time.Now()
+	var missing []string
+	for _, key := range keys {
+		if expires, ok := m.grants[user][key]; !ok || !now.Before(expires) {
+			missing = append(missing, key)
+		}
+	}
+	return missing, nil
+}
+
+// grantChunks records that a user holds chunks of a dedup domain. A failure
+// only means the user has to prove the chunks again, so it is logged.
+func grantChunks(user, domain string, shas []string) {
+	if len(shas) == 0 {
+		return
+	}
+	keys := make([]string, len(shas))
+	for i, sha := range shas {
+		keys[i] = chunkKey(domain, sha)
+	}
+	if err := Grants.Grant(ctx, user, keys); err != nil {
+		log.Printf("Failed to record %d chunks held by %s: %v", len(keys), user, err)
+	}
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Chunks are encrypted at rest with AES-256-GCM, one chunk at a time so
+// ranged reads keep working. A stored chunk is nonce (12 bytes) followed by
+// the ciphertext and tag, and the chunk's SHA is bound in as additional data
+// so a record cannot be swapped for another. Encryption runs after
+// compression. Each chunk records the ID of its key in ChunkMeta.KeyID.
+//
+// Where keys come from is up to the KeyProvider picked by KEY_PROVIDER:
+//
+//   - local: keys are read from the JSON KEY_FILE, meant for development
+//   - envelope: random data keys are wrapped with the KEY_MASTER key and
+//     stored in the blob store under keys/, along with a pointer to the
+//     current one; the master key never touches storage
+//   - convergent: every chunk gets its own key derived from its SHA and the
+//     KEY_SECRET server secret, and a nonce derived from its content, so the
+//     same chunk always encrypts to the same bytes (see ConvergentKeyProvider)
+//
+// Without KEY_PROVIDER chunks are stored in plaintext.
+type KeyProvider interface {
+	// Current returns the key new chunks are encrypted with, creating it if
+	// the provider has none yet
+	Current(ctx context.Context) (id string, key []byte, err error)
+	// CurrentID returns the ID Current would return without creating
+	// anything, "" if there is no key yet
+	CurrentID(ctx context.Context) (string, error)
+	// Key looks up any key by ID, for decryption
+	Key(ctx context.Context, id string) ([]byte, error)
+}
+
+var Keys KeyProvider
+
+var ErrUnknownKey = errors.New("unknown encryption key")
+
+func InitKeys() {
+	switch provider := os.Getenv("KEY_PROVIDER"); provider {
+	case "":
+		log.Println("Chunk encryption is off, set KEY_PROVIDER to enable it")
+	case "local":
+		path := os.Getenv("KEY_FILE")
+		if path == "" {
+			path = "keys.json"
+		}
+		p, err := NewLocalKeyProvider(path)
+		if err != nil {
+			log.Fatalf("Failed to load key file: %v", err)
+		}
+		Keys = p
+		log.Printf("Encrypting chunks with keys from %s", path)
+	case "envelope":
+		master, err := base64.StdEncoding.DecodeString(os.Getenv("KEY_MASTER"))
+		if err != nil || len(master) != 32 {
+			log.Fatal("KEY_MASTER must be a base64 encoded 32 byte key")
+		}
+		Keys = NewEnvelopeKeyProvider(master, Blobs)
+		log.Println("Encrypting chunks with envelope keys")
+	case "convergent":
+		p, err := NewConvergentKeyProvider(os.Getenv("KEY_SECRET"))
+		if err != nil {
+			log.Fatalf("Invalid KEY_SECRET: %v", err)
+		}
+		Keys = p
+		log.Printf("Encrypting chunks with convergent keys (%s)", p.current)
+	default:
+		log.Fatalf("Unknown KEY_PROVIDER %q (expected local, envelope or convergent)", provider)
+	}
+}
+
+// sealChunk encrypts a stored chunk with the current key. It returns the data
+// unchanged and an empty key ID when encryption is off.
+func sealChunk(sha string, data []byte) ([]byte, string, error) {
+	if Keys == nil {
+		return data, "", nil
+	}
+	id, key, err := Keys.Current(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	aad, err := hex.DecodeString(sha)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if isConvergentKey(id) {
+		key = convergentChunkKey(key, aad)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if isConvergentKey(id) {
+		// Deterministic, but a nonce only repeats for the same key and the
+		// same bytes, which is exactly when the ciphertext should repeat
+		mac := hmac.New(sha256.New, key)
+		mac.Write(data)
+		copy(nonce, mac.Sum(nil))
+	} else if _, err := rand.Read(nonce); err != nil {
+		return nil, "", err
+	}
+	return gcm.Seal(nonce, nonce, data, aad), id, nil
+}
+
+// openChunk reverses sealChunk
+func openChunk(sha, keyID string, data []byte) ([]byte, error) {
+	if keyID == "" {
+		return data, nil
+	}
+	if Keys == nil {
+		return nil, fmt.Errorf("chunk is encrypted with key %s but KEY_PROVIDER is not set", keyID)
+	}
+	key, err := Keys.Key(ctx, keyID)
+	if err != nil {
+		return nil, err
+	}
+	aad, err := hex.DecodeString(sha)
+	if err != nil {
+		return nil, err
+	}
+
+	if isConvergentKey(keyID) {
+		key = convergentChunkKey(key, aad)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize()+gcm.Overhead() {
+		return nil, errors.New("encrypted chunk is too short")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], aad)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt chunk with key %s: %v", keyID, err)
+	}
+	return plain, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// LocalKeyProvider reads keys from a JSON file:
+//
+//	{"current": "2025-01", "keys": {"2025-01": "<base64 32 bytes>"}}
+//
+// Rotating means adding a key, pointing current at it, restarting the upload
+// service and running rotate-keys. Old keys must stay in the file until
+// rotate-keys has rewritten every chunk that uses them.
+type LocalKeyProvider struct {
+	current string
+	keys    map[string][]byte
+}
+
+func NewLocalKeyProvider(path string) (*LocalKeyProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		Current string            `json:"current"`
+		Keys    map[string]string `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	p := &LocalKeyProvider{current: file.Current, keys: make(map[string][]byte)}
+	for id, encoded := range file.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("key %s must be a base64 encoded 32 byte key", id)
+		}
+		p.keys[id] = key
+	}
+	if _, ok := p.keys[p.current]; !ok {
+		return nil, fmt.Errorf("current key %q is not in %s", p.current, path)
+	}
+	return p, nil
+}
+
+func (p *LocalKeyProvider) Current(ctx context.Context) (string, []byte, error) {
+	return p.current, p.keys[p.current], nil
+}
+
+func (p *LocalKeyProvider) CurrentID(ctx context.Context) (string, error) {
+	return p.current, nil
+}
+
+func (p *LocalKeyProvider) Key(ctx context.Context, id string) ([]byte, error) {
+	key, ok := p.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrUnknownKey, id)
+	}
+	return key, nil
+}
+
+// EnvelopeKeyProvider keeps data keys in the blob store, each wrapped
+// (AES-GCM) with the master key. The ID of the key new chunks are encrypted
+// with is kept in the pointer object keys/current, so every instance and
+// every command run uses the same key until Rotate replaces it. The first
+// Current call on an empty store creates the first key. Running instances
+// re-read the pointer every envelopeKeyRefresh to pick up a rotation.
+type EnvelopeKeyProvider struct {
+	master []byte
+	store  BlobStore
+
+	lock      sync.RWMutex
+	currentID string
+	checked   time.Time // when the pointer was last read
+	cache     map[string][]byte
+}
+
+const (
+	envelopeKeyPrefix  = "keys/"
+	envelopeCurrentKey = envelopeKeyPrefix + "current"
+	envelopeKeyRefresh = time.Minute
+)
+
+func NewEnvelopeKeyProvider(master []byte, store BlobStore) *EnvelopeKeyProvider {
+	return &EnvelopeKeyProvider{master: master, store: store, cache: make(map[string][]byte)}
+}
+
+func (p *EnvelopeKeyProvider) Current(ctx context.Context) (string, []byte, error) {
+	p.lock.RLock()
+	id := p.currentID
+	key := p.cache[id]
+	fresh := time.Since(p.checked) < envelopeKeyRefresh
+	p.lock.RUnlock()
+	if id != "" && fresh {
+		return id, key, nil
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.currentID != "" && time.Since(p.checked) < envelopeKeyRefresh {
+		return p.currentID, p.cache[p.currentID], nil
+	}
+
+	id, err := p.readPointer(ctx)
+	if err != nil {
+		if p.currentID != "" {
+			// Keep encrypting with the key we have and look again next time
+			log.Printf("Failed to read the current data key, still using %s: %v", p.currentID, err)
+			return p.currentID, p.cache[p.currentID], nil
+		}
+		return "", nil, err
+	}
+	if id == "" {
+		if id, err = p.rotateLocked(ctx); err != nil {
+			return "", nil, err
+		}
+	}
+	key, ok := p.cache[id]
+	if !ok {
+		if key, err = p.unwrap(ctx, id); err != nil {
+			return "", nil, err
+		}
+	}
+
+	if id != p.currentID && p.currentID != "" {
+		log.Printf("Switching to data key %s", id)
+	}
+	p.currentID = id
+	p.checked = time.Now()
+	p.cache[id] = key
+	return id, key, nil
+}
+
+// CurrentID returns the ID in the pointer, "" before the first key exists.
+// It never creates a key.
+func (p *EnvelopeKeyProvider) CurrentID(ctx context.Context) (string, error) {
+	return p.readPointer(ctx)
+}
+
+// Rotate creates a new data key and makes it current for every instance
+func (p *EnvelopeKeyProvider) Rotate(ctx context.Context) (string, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	id, err := p.rotateLocked(ctx)
+	if err != nil {
+		return "", err
+	}
+	p.currentID = ""
+	return id, nil
+}
+
+// rotateLocked stores a new wrapped data key and points keys/current at it
+func (p *EnvelopeKeyProvider) rotateLocked(ctx context.Context) (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	id := uuid.New().String()
+
+	gcm, err := newGCM(p.master)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	wrapped := gcm.Seal(nonce, nonce, key, []byte(id))
+	if err := p.store.Put(ctx, envelopeKeyPrefix+id, bytes.NewReader(wrapped)); err != nil {
+		return "", fmt.Errorf("failed to store data key: %v", err)
+	}
+	if err := p.store.Put(ctx, envelopeCurrentKey, strings.NewReader(id)); err != nil {
+		return "", fmt.Errorf("failed to make data key %s current: %v", id, err)
+	}
+
+	p.cache[id] = key
+	log.Printf("Created data key %s", id)
+	return id, nil
+}
+
+// readPointer returns the ID keys/current names, "" if there is none
+func (p *EnvelopeKeyProvider) readPointer(ctx context.Context) (string, error) {
+	info, err := p.store.Head(ctx, envelopeCurrentKey)
+	if errors.Is(err, ErrBlobNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read the current data key: %v", err)
+	}
+	id, err := p.store.GetRange(ctx, envelopeCurrentKey, 0, info.Size-1)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the current data key: %v", err)
+	}
+	return strings.TrimSpace(string(id)), nil
+}
+
+func (p *EnvelopeKeyProvider) Key(ctx context.Context, id string) ([]byte, error) {
+	p.lock.RLock()
+	key, ok := p.cache[id]
+	p.lock.RUnlock()
+	if ok {
+		return key, nil
+	}
+
+	key, err := p.unwrap(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	p.lock.Lock()
+	p.cache[id] = key
+	p.lock.Unlock()
+	return key, nil
+}
+
+// unwrap fetches a stored data key and decrypts it with the master key
+func (p *EnvelopeKeyProvider) unwrap(ctx context.Context, id string) ([]byte, error) {
+	info, err := p.store.Head(ctx, envelopeKeyPrefix+id)
+	if errors.Is(err, ErrBlobNotFound) {
+		return nil, fmt.Errorf("%w %s", ErrUnknownKey, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := p.store.GetRange(ctx, envelopeKeyPrefix+id, 0, info.Size-1)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(p.master)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < gcm.NonceSize() {
+		return nil, fmt.Errorf("wrapped key %s is too short", id)
+	}
+	key, err := gcm.Open(nil, wrapped[:gcm.NonceSize()], wrapped[gcm.NonceSize():], []byte(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap key %s: %v", id, err)
+	}
+	return key, nil
+}
+
+// ConvergentKeyProvider derives every chunk's key from the chunk's SHA-256
+// with HMAC-SHA256 keyed by a server secret. Identical chunks encrypt to
+// identical bytes no matter which instance packs them or when, so encrypted
+// copies can still be recognised as duplicates, and nothing per user or per
+// instance has to be stored.
+//
+// The tradeoffs compared to envelope keys:
+//
+//   - equal ciphertext means equal plaintext: anyone who can read the bucket
+//     learns which records hold the same chunk, though not what it is
+//   - whoever holds KEY_SECRET can encrypt a guessed chunk and check whether
+//     it is stored, so the secret protects against outsiders only
+//   - all chunks hang off one secret; if it leaks every chunk is exposed, and
+//     replacing it means re-encrypting everything with rotate-keys
+//   - chunks are not isolated per user; access control stays with the index
+//     and the download service, as without encryption
+//
+// The key ID is "convergent-" and a fingerprint of the secret, so chunks
+// written with a different secret are refused instead of decrypted to junk.
+type ConvergentKeyProvider struct {
+	current string
+	secrets map[string][]byte
+}
+
+const convergentKeyPrefix = "convergent-"
+
+// NewConvergentKeyProvider takes comma separated base64 secrets of at least
+// 32 bytes. The first one encrypts new chunks; the rest are kept so chunks
+// written with them can be read until rotate-keys has rewritten them.
+func NewConvergentKeyProvider(secrets string) (*ConvergentKeyProvider, error) {
+	p := &ConvergentKeyProvider{secrets: make(map[string][]byte)}
+	for _, encoded := range strings.Split(secrets, ",") {
+		secret, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil || len(secret) < 32 {
+			return nil, errors.New("each secret must be base64 encoded and at least 32 bytes")
+		}
+		id := convergentKeyID(secret)
+		if p.current == "" {
+			p.current = id
+		}
+		p.secrets[id] = secret
+	}
+	return p, nil
+}
+
+func (p *ConvergentKeyProvider) Current(ctx context.Context) (string, []byte, error) {
+	return p.current, p.secrets[p.current], nil
+}
+
+func (p *ConvergentKeyProvider) CurrentID(ctx context.Context) (string, error) {
+	return p.current, nil
+}
+
+func (p *ConvergentKeyProvider) Key(ctx context.Context, id string) ([]byte, error) {
+	secret, ok := p.secrets[id]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrUnknownKey, id)
+	}
+	return secret, nil
+}
+
+func convergentKeyID(secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("neurostore key id"))
+	return convergentKeyPrefix + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+func isConvergentKey(id string) bool {
+	return strings.HasPrefix(id, convergentKeyPrefix)
+}
+
+// convergentChunkKey derives the key of one chunk from the secret and its SHA
+func convergentChunkKey(secret, sha []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(sha)
+	return mac.Sum(nil)
+}
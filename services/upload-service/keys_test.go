@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"strings"
+	"testing"
+)
+
+func testMasterKey(t *testing.T) []byte {
+	t.Helper()
+	master := make([]byte, 32)
+	if _, err := rand.Read(master); err != nil {
+		t.Fatal(err)
+	}
+	return master
+}
+
+func storedKeys(t *testing.T, store BlobStore) []string {
+	t.Helper()
+	infos, err := store.List(context.Background(), envelopeKeyPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, info := range infos {
+		keys = append(keys, info.Key)
+	}
+	return keys
+}
+
+func TestEnvelopeKeyStaysCurrent(t *testing.T) {
+	store := NewMemoryBlobStore()
+	master := testMasterKey(t)
+
+	first := NewEnvelopeKeyProvider(master, store)
+	if id, err := first.CurrentID(ctx); err != nil || id != "" {
+		t.Fatalf("CurrentID on an empty store is %q, %v", id, err)
+	}
+	if keys := storedKeys(t, store); len(keys) != 0 {
+		t.Fatalf("CurrentID stored %v", keys)
+	}
+
+	id, key, err := first.Current(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another instance or a later command run uses the same key
+	second := NewEnvelopeKeyProvider(master, store)
+	id2, key2, err := second.Current(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id2 != id || !bytes.Equal(key2, key) {
+		t.Fatalf("second provider uses key %s, want %s", id2, id)
+	}
+	if current, _ := second.CurrentID(ctx); current != id {
+		t.Errorf("CurrentID is %s, want %s", current, id)
+	}
+	if keys := storedKeys(t, store); len(keys) != 2 {
+		t.Errorf("store holds %v, want one data key and the pointer", keys)
+	}
+
+	// Rotating switches the rotating provider at once and the others on
+	// their next refresh
+	rotated, err := second.Rotate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated == id {
+		t.Fatal("Rotate kept the old key")
+	}
+	if got, _, _ := second.Current(ctx); got != rotated {
+		t.Errorf("rotating provider uses %s, want %s", got, rotated)
+	}
+	if got, _, _ := first.Current(ctx); got != id {
+		t.Errorf("other provider switched before its refresh")
+	}
+	first.checked = first.checked.Add(-envelopeKeyRefresh)
+	if got, _, _ := first.Current(ctx); got != rotated {
+		t.Errorf("other provider uses %s after its refresh, want %s", got, rotated)
+	}
+
+	// Chunks under the old key stay readable
+	old, err := first.Key(ctx, id)
+	if err != nil || !bytes.Equal(old, key) {
+		t.Errorf("old key is %x, %v", old, err)
+	}
+
+	// A different master key cannot unwrap them
+	other := NewEnvelopeKeyProvider(testMasterKey(t), store)
+	if _, err := other.Key(ctx, id); err == nil {
+		t.Error("key unwrapped with the wrong master key")
+	}
+}
+
+func TestSealChunkRoundTrip(t *testing.T) {
+	local := &LocalKeyProvider{current: "k1", keys: map[string][]byte{"k1": testMasterKey(t)}}
+	convergent, err := NewConvergentKeyProvider("c2VjcmV0IHNlY3JldCBzZWNyZXQgc2VjcmV0IHNlY3JldA==")
+	if err != nil {
+		t.Fatal(err)
+	}
+	providers := map[string]KeyProvider{
+		"local":      local,
+		"envelope":   NewEnvelopeKeyProvider(testMasterKey(t), NewMemoryBlobStore()),
+		"convergent": convergent,
+	}
+
+	defer func(keys KeyProvider) { Keys = keys }(Keys)
+	data := []byte(strings.Repeat("chunk ", 100))
+	sha := shaOf(data)
+	for name, p := range providers {
+		t.Run(name, func(t *testing.T) {
+			Keys = p
+			sealed, keyID, err := sealChunk(sha, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if current, _ := p.CurrentID(ctx); keyID != current {
+				t.Errorf("sealed with %s, current is %s", keyID, current)
+			}
+			plain, err := openChunk(sha, keyID, sealed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(plain, data) {
+				t.Error("chunk does not round trip")
+			}
+			if _, err := openChunk(shaOf(nil), keyID, sealed); err == nil {
+				t.Error("chunk opened under another sha")
+			}
+		})
+	}
+}
+
+func TestRekeyDryRunCreatesNoKey(t *testing.T) {
+	defer func(keys KeyProvider, blobs BlobStore, index ChunkIndex) {
+		Keys, Blobs, Index = keys, blobs, index
+	}(Keys, Blobs, Index)
+
+	store := NewMemoryBlobStore()
+	Blobs = store
+	Keys = NewEnvelopeKeyProvider(testMasterKey(t), store)
+	Index, _ = NewMemoryChunkIndex("")
+
+	pack := "chunk_set_1"
+	store.Put(ctx, pack, bytes.NewReader(make([]byte, 100)))
+	Index.PutBatch(ctx, map[string]ChunkMeta{testSHA(1): {Filename: pack, Start: 5, End: 14}})
+
+	journal := &compactJournal{Retiring: make(map[string]int64)}
+	candidates, err := compactionCandidates(ctx, journal, CompactOptions{Rekey: true, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 1 {
+		t.Errorf("%d packs to rekey, want the plaintext one", len(candidates))
+	}
+	if keys := storedKeys(t, store); len(keys) != 0 {
+		t.Errorf("dry run stored %v", keys)
+	}
+}
@@ -1,13 +1,16 @@
 package main
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"sort"
+	"strings"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -26,11 +29,7 @@ func saveChunksToFile(chunks []Chunk) error {
 	var outputFile string
 
 	for i, chunk := range chunks {
-		decoded, err := base64.StdEncoding.DecodeString(chunk.Data)
-		if err != nil {
-			return fmt.Errorf("failed to decode chunk %d: %v", chunk.ChunkNo, err)
-		}
-		fileData = append(fileData, decoded...)
+		fileData = append(fileData, chunk.Bytes...)
 
 		if i == 0 {
 			outputFile = chunk.FileName
@@ -48,15 +47,96 @@ type Chunk struct {
 	SHA      string `json:"sha"`
 	FileName string `json:"filename"`
 	Data     string `json:"data"`
+
+	// Bytes is the decoded Data, filled in once the SHA has been verified
+	Bytes []byte `json:"-"`
+
+	// Domain is the dedup domain of the upload, see domain.go
+	Domain string `json:"-"`
+
+	// segment is the ingest WAL segment holding this chunk
+	segment uint64
+}
+
+// UploadMessage is a control message on /ws/upload. A client that wants to
+// skip chunks the server already stores first sends {"type":"have"} with every
+// SHA of the file; the server answers {"type":"need"} with the ones it lacks
+// and the client only uploads those before "__EOF__". Unless OWNERSHIP_PROOF
+// is off, the "need" message also carries challenges for the chunks the server
+// already has (see ownership.go). The client answers with {"type":"proof"} and
+// gets a second "need" listing the challenged chunks it must upload after all.
+//
+// To make an upload resumable the client sends {"type":"session"} before any
+// chunk. The server answers with a session_id and from then on acknowledges
+// every chunk once it is safely on disk. After a dropped connection the client
+// sends {"type":"session","session_id":...} and gets back the SHAs the session
+// already holds.
+type UploadMessage struct {
+	Type      string   `json:"type,omitempty"`
+	SessionID string   `json:"session_id,omitempty"`
+	SHAs      []string `json:"shas,omitempty"`
+
+	Challenges []OwnershipChallenge `json:"challenges,omitempty"`
+	Proofs     []OwnershipProof     `json:"proofs,omitempty"`
+}
+
+// ChunkAck confirms a chunk of a session upload was stored
+type ChunkAck struct {
+	Type    string `json:"type"` // always "ack"
+	ChunkNo int    `json:"chunk_no"`
+	SHA     string `json:"sha"`
+}
+
+// ChunkError tells the client a chunk was rejected and will not be stored
+type ChunkError struct {
+	Type    string `json:"type"` // always "error"
+	ChunkNo int    `json:"chunk_no"`
+	SHA     string `json:"sha"`
+	Error   string `json:"error"`
+}
+
+// verifyChunk checks the chunk really hashes to its claimed SHA, decoding
+// legacy base64 Data first. Without this a client could store arbitrary bytes
+// under someone else's SHA and every later file containing that chunk would
+// download the wrong data.
+func verifyChunk(chunk *Chunk) error {
+	if chunk.Bytes == nil {
+		data, err := base64.StdEncoding.DecodeString(chunk.Data)
+		if err != nil {
+			rejectedChunks.Add("bad_encoding", 1)
+			return fmt.Errorf("failed to decode chunk data: %v", err)
+		}
+		chunk.Bytes = data
+		chunk.Data = ""
+	}
+
+	sum := sha256.Sum256(chunk.Bytes)
+	if hex.EncodeToString(sum[:]) != strings.ToLower(chunk.SHA) {
+		rejectedChunks.Add("sha_mismatch", 1)
+		return fmt.Errorf("chunk data does not match sha %s", chunk.SHA)
+	}
+
+	chunk.SHA = strings.ToLower(chunk.SHA)
+	return nil
 }
 
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+	CheckOrigin:  checkOrigin,
+	Subprotocols: []string{chunkFrameProtocol},
 }
 
 func handleWebSocketUpload(c *gin.Context) {
+	caller, err := authenticate(c.Request)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	domain, err := principalDomain(caller)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		log.Println("WebSocket upgrade error:", err)
@@ -64,51 +144,260 @@ func handleWebSocketUpload(c *gin.Context) {
 	}
 	defer conn.Close()
 
-	fmt.Println("WebSocket client connected")
+	binaryFrames := conn.Subprotocol() == chunkFrameProtocol
+	fmt.Printf("WebSocket client %s connected, binary frames: %v\n", caller.UserID, binaryFrames)
 
 	var allChunks []Chunk
+	var session *UploadSession
+	eof := false
+
+	// Challenges sent with the last "need" and not answered yet
+	pending := make(map[string]OwnershipChallenge)
 
 	for {
-		_, msg, err := conn.ReadMessage()
+		msgType, msg, err := conn.ReadMessage()
 		if err != nil {
 			log.Println("Error reading from WebSocket:", err)
 			break
 		}
 
-		if string(msg) == "__EOF__" {
-			fmt.Println("Upload complete")
-			break
+		var chunk Chunk
+		if msgType == websocket.BinaryMessage {
+			if !binaryFrames {
+				conn.WriteJSON(ChunkError{Type: "error", Error: "binary frames were not negotiated"})
+				continue
+			}
+			receivedChunks.Add(1)
+			chunk, err = decodeChunkFrame(msg)
+			if err != nil {
+				rejectedChunks.Add("bad_frame", 1)
+				log.Printf("Rejected frame for chunk %d: %v", chunk.ChunkNo, err)
+				conn.WriteJSON(ChunkError{Type: "error", ChunkNo: chunk.ChunkNo, SHA: chunk.SHA, Error: err.Error()})
+				continue
+			}
+		} else {
+			if string(msg) == "__EOF__" {
+				fmt.Println("Upload complete")
+				eof = true
+				break
+			}
+
+			// Chunk messages carry no type, anything else is a control message
+			var in struct {
+				UploadMessage
+				Chunk
+			}
+			if err := json.Unmarshal(msg, &in); err != nil {
+				log.Println("Failed to unmarshal chunk:", err)
+				continue
+			}
+
+			switch in.Type {
+			case "":
+				chunk = in.Chunk
+				receivedChunks.Add(1)
+			case "have":
+				need, challenges, err := answerHaveList(domain, in.SHAs, allChunks)
+				if err != nil {
+					log.Println("Failed to answer have-list:", err)
+					conn.WriteJSON(ChunkError{Type: "error", Error: err.Error()})
+					continue
+				}
+				for _, c := range challenges {
+					pending[c.SHA] = c
+				}
+				fmt.Printf("Have-list of %d chunks, %d missing, %d challenged\n", len(in.SHAs), len(need), len(challenges))
+				conn.WriteJSON(UploadMessage{Type: "need", SHAs: need, Challenges: challenges})
+				continue
+			case "proof":
+				need := checkProofs(caller.UserID, domain, pending, in.Proofs)
+				fmt.Printf("Ownership proofs for %d chunks, %d failed\n", len(in.Proofs), len(need))
+				conn.WriteJSON(UploadMessage{Type: "need", SHAs: need})
+				continue
+			case "session":
+				if session != nil {
+					conn.WriteJSON(ChunkError{Type: "error", Error: "session already started"})
+					continue
+				}
+
+				var held []Chunk
+				if in.SessionID == "" {
+					session, err = Sessions.Create(caller.UserID)
+				} else {
+					session, held, err = Sessions.Resume(in.SessionID, caller.UserID)
+				}
+				if err != nil {
+					log.Println("Failed to open upload session:", err)
+					conn.WriteJSON(ChunkError{Type: "error", Error: err.Error()})
+					continue
+				}
+				defer session.Detach()
+
+				heldSHAs := []string{}
+				for i := range held {
+					held[i].Domain = domain
+					heldSHAs = append(heldSHAs, held[i].SHA)
+				}
+				allChunks = append(allChunks, held...)
+
+				fmt.Printf("Upload session %s attached with %d chunks\n", session.ID, len(held))
+				conn.WriteJSON(UploadMessage{Type: "session", SessionID: session.ID, SHAs: heldSHAs})
+				continue
+			default:
+				conn.WriteJSON(ChunkError{Type: "error", Error: "unknown message type " + in.Type})
+				continue
+			}
 		}
 
-		var chunk Chunk
-		if err := json.Unmarshal(msg, &chunk); err != nil {
-			log.Println("Failed to unmarshal chunk:", err)
+		if err := verifyChunk(&chunk); err != nil {
+			log.Printf("Rejected chunk %d: %v", chunk.ChunkNo, err)
+			conn.WriteJSON(ChunkError{
+				Type:    "error",
+				ChunkNo: chunk.ChunkNo,
+				SHA:     chunk.SHA,
+				Error:   err.Error(),
+			})
 			continue
 		}
 
+		chunk.Domain = domain
+
+		if session != nil {
+			if err := session.Save(chunk); err != nil {
+				log.Printf("Failed to save chunk %d to session %s: %v", chunk.ChunkNo, session.ID, err)
+				conn.WriteJSON(ChunkError{Type: "error", ChunkNo: chunk.ChunkNo, SHA: chunk.SHA, Error: "failed to store chunk"})
+				continue
+			}
+			conn.WriteJSON(ChunkAck{Type: "ack", ChunkNo: chunk.ChunkNo, SHA: chunk.SHA})
+		}
+
 		allChunks = append(allChunks, chunk)
 	}
 
+	// A session keeps its chunks on disk until the client comes back and finishes
+	if session != nil && !eof {
+		fmt.Printf("Upload session %s interrupted with %d chunks\n", session.ID, len(allChunks))
+		return
+	}
+
 	if len(allChunks) == 0 {
 		fmt.Println("No chunks received")
+		if session != nil {
+			session.Finish()
+		}
 		return
 	}
 
+	if _, err := enqueueNewChunks(allChunks); err != nil {
+		log.Println("Error checking SHA existence:", err)
+		conn.WriteJSON(ChunkError{Type: "error", Error: "failed to queue chunks, resume the session to retry"})
+		return
+	}
+	grantChunks(caller.UserID, domain, chunkSHAs(allChunks))
+	if session != nil {
+		session.Finish()
+	}
+}
+
+// answerHaveList returns the SHAs of a have-list the client has to send and,
+// when ownership proofs are on, challenges for the ones the server already has
+// in the client's dedup domain
+func answerHaveList(domain string, shas []string, received []Chunk) ([]string, []OwnershipChallenge, error) {
+	missing, existing, err := missingChunks(domain, shas, received)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !requireOwnershipProof || len(existing) == 0 {
+		touchChunks(domain, existing)
+		return missing, nil, nil
+	}
+
+	challenges, gone, err := newChallenges(domain, existing)
+	if err != nil {
+		return nil, nil, err
+	}
+	return append(missing, gone...), challenges, nil
+}
+
+// missingChunks splits a have-list into the SHAs the domain's index lacks and
+// the ones it has, in the order the client listed them. Chunks already
+// received on this connection or held by its session are in neither.
+func missingChunks(domain string, shas []string, received []Chunk) ([]string, []string, error) {
+	var unique []string
+	seen := make(map[string]bool, len(shas)+len(received))
+	for _, chunk := range received {
+		seen[chunk.SHA] = true
+	}
+
+	for _, sha := range shas {
+		sha = strings.ToLower(sha)
+		if !isSHA256Hex(sha) {
+			return nil, nil, fmt.Errorf("invalid sha %q in have-list", sha)
+		}
+		if seen[sha] {
+			continue
+		}
+		seen[sha] = true
+		unique = append(unique, sha)
+	}
+
+	if len(unique) == 0 {
+		return []string{}, nil, nil
+	}
+
+	existing, missing, err := existsInDomain(domain, unique)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to check existing chunks: %v", err)
+	}
+	if missing == nil {
+		missing = []string{}
+	}
+	return missing, existing, nil
+}
+
+// existsInDomain is Index.Exists for the SHAs of one dedup domain
+func existsInDomain(domain string, shas []string) (existing []string, missing []string, err error) {
+	keys := make([]string, len(shas))
+	for i, sha := range shas {
+		keys[i] = chunkKey(domain, sha)
+	}
+	existingKeys, missingKeys, err := Index.Exists(ctx, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, key := range existingKeys {
+		_, sha, _ := splitChunkKey(key)
+		existing = append(existing, sha)
+	}
+	for _, key := range missingKeys {
+		_, sha, _ := splitChunkKey(key)
+		missing = append(missing, sha)
+	}
+	return existing, missing, nil
+}
+
+// enqueueNewChunks drops chunks the index already has and queues the rest,
+// returning how many were queued. All chunks are from the same dedup domain.
+func enqueueNewChunks(allChunks []Chunk) (int, error) {
 	// Collect SHA list and build SHA → Chunk map
 	var shaList []string
 	shaToChunk := make(map[string]Chunk)
 
-	//can u adda log.fatal here if key already exist in the map
+	// The same chunk can repeat within a file, only queue it once
 	for _, chunk := range allChunks {
+		if _, seen := shaToChunk[chunk.SHA]; seen {
+			continue
+		}
 		shaList = append(shaList, chunk.SHA)
 		shaToChunk[chunk.SHA] = chunk
 	}
+	domain := allChunks[0].Domain
 
-	_, nonExisting, err := CheckSHAExistence(RedisClient, shaList)
+	existing, nonExisting, err := existsInDomain(domain, shaList)
 	if err != nil {
-		log.Println("Error checking SHA existence:", err)
-		return
+		return 0, err
 	}
+	touchChunks(domain, existing)
 
 	var newChunks []Chunk
 	for _, sha := range nonExisting {
@@ -117,28 +406,186 @@ func handleWebSocketUpload(c *gin.Context) {
 
 	if len(newChunks) == 0 {
 		fmt.Println(" All chunks already existed. Nothing to enqueue.")
-		return
+		return 0, nil
 	}
 
-	globalQueue.EnqueueBack(newChunks)
+	if err := globalQueue.EnqueueBack(newChunks); err != nil {
+		return 0, fmt.Errorf("failed to queue chunks: %v", err)
+	}
 	fmt.Printf(" Enqueued %d new chunks into queue\n", len(newChunks))
+	return len(newChunks), nil
+}
+
+// chunkSHAs lists the SHAs of chunks
+func chunkSHAs(chunks []Chunk) []string {
+	shas := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		shas[i] = chunk.SHA
+	}
+	return shas
+}
+
+// maxImportSize matches the largest file the browser client accepts
+const maxImportSize = 150 << 20
+
+// handleImport chunks a raw request body on the server for clients that cannot
+// run the wasm chunker. The response lists the blocks in the same shape the
+// browser registers with the backend, so both kinds of upload dedup together.
+func handleImport(c *gin.Context) {
+	caller, err := authenticate(c.Request)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	domain, err := principalDomain(caller)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, maxImportSize)
+	filename := c.Query("filename")
+
+	var blocks []Block
+	var chunks []Chunk
+	err = ChunkReader(body, func(b Block, data []byte) error {
+		blocks = append(blocks, b)
+		chunks = append(chunks, Chunk{
+			ChunkNo:  b.ChunkNo,
+			SHA:      b.SHA,
+			FileName: filename,
+			Bytes:    append([]byte(nil), data...),
+			Domain:   domain,
+		})
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("failed to read body: %v", err)})
+		return
+	}
+	if len(chunks) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "empty body"})
+		return
+	}
+
+	queued, err := enqueueNewChunks(chunks)
+	if err != nil {
+		log.Println("Error checking SHA existence:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check existing chunks"})
+		return
+	}
+	grantChunks(caller.UserID, domain, chunkSHAs(chunks))
+
+	c.JSON(http.StatusOK, gin.H{"chunks": blocks, "queued": queued})
+}
+
+// maxRecipeCheckSize fits the SHAs of the largest file the client accepts
+// cut into the smallest chunks
+const maxRecipeCheckSize = 8 << 20
+
+// RecipeCheck lists the chunk SHAs of a recipe the backend is about to
+// register; the answer lists the ones the caller may not reference and the
+// dedup domain the caller's chunks are stored in, which the backend records
+// with the recipe so downloads find them whoever asks
+type RecipeCheck struct {
+	SHAs    []string `json:"shas,omitempty"`
+	Missing []string `json:"missing"`
+	Domain  string   `json:"domain"`
+}
+
+// handleCheckRecipe serves POST /recipes/check. The backend calls it with the
+// caller's token before registering a recipe and refuses the recipe if any
+// SHA comes back missing: one the caller has neither uploaded nor proven to
+// hold within ownershipGrantTTL. Without this anyone knowing a hash could
+// register a recipe naming it and download the chunk.
+func handleCheckRecipe(c *gin.Context) {
+	caller, err := authenticate(c.Request)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	domain, err := principalDomain(caller)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	var req RecipeCheck
+	if err := json.NewDecoder(http.MaxBytesReader(c.Writer, c.Request.Body, maxRecipeCheckSize)).Decode(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid body: %v", err)})
+		return
+	}
+
+	var keys []string
+	seen := make(map[string]bool, len(req.SHAs))
+	for _, sha := range req.SHAs {
+		sha = strings.ToLower(sha)
+		if !isSHA256Hex(sha) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid sha %q", sha)})
+			return
+		}
+		if !seen[sha] {
+			seen[sha] = true
+			keys = append(keys, chunkKey(domain, sha))
+		}
+	}
+
+	missing := []string{}
+	if requireOwnershipProof {
+		missingKeys, err := Grants.Missing(ctx, caller.UserID, keys)
+		if err != nil {
+			log.Println("Failed to check recipe:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check recipe"})
+			return
+		}
+		for _, key := range missingKeys {
+			_, sha, _ := splitChunkKey(key)
+			missing = append(missing, sha)
+		}
+	}
+	if len(missing) > 0 {
+		recipeChecks.Add("refused", 1)
+		log.Printf("Recipe of %d chunks by %q names %d chunks it does not hold", len(keys), caller.UserID, len(missing))
+	} else {
+		recipeChecks.Add("accepted", 1)
+	}
+	c.JSON(http.StatusOK, RecipeCheck{Missing: missing, Domain: domain})
 }
 
 func main() {
-	InitRedis()
-	InitS3()
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1:])
+		return
+	}
+
+	InitChunkIndex()
+	InitBlobStore()
+	InitKeys()
+	InitAuth()
+	InitChunkCodec()
+	InitDedupDomain()
+	InitOwnershipProof()
+	InitOwnershipGrants()
+	InitSessionStore()
+	InitDeadLetters()
+	InitIngestQueue()
+	StartGCLoop()
+	StartCompactionLoop()
 
 	StartDispatcher(globalQueue)
+	StartAdminServer()
 
 	r := gin.Default()
 	r.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"http://localhost:5173"},
+		AllowOriginFunc:  func(origin string) bool { return allowedOrigins["*"] || allowedOrigins[origin] },
 		AllowMethods:     []string{"GET", "POST"},
-		AllowHeaders:     []string{"Content-Type"},
+		AllowHeaders:     []string{"Content-Type", "Authorization"},
 		AllowCredentials: true,
 	}))
 
 	r.GET("/ws/upload", handleWebSocketUpload)
+	r.POST("/import", handleImport)
+	r.POST("/recipes/check", handleCheckRecipe)
 
 	fmt.Println("Server running on http://localhost:3000")
 	r.Run(":3000")
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+	"os"
+)
+
+// Counters are published through expvar on /debug/vars of the admin listener
+var (
+	receivedChunks = expvar.NewInt("upload_chunks_received")
+	rejectedChunks = expvar.NewMap("upload_chunks_rejected")
+
+	// ownershipProofs counts have-list challenges by outcome (passed, failed)
+	ownershipProofs = expvar.NewMap("upload_ownership_proofs")
+
+	// recipeChecks counts recipes checked for the backend by outcome
+	// (accepted, refused)
+	recipeChecks = expvar.NewMap("upload_recipe_checks")
+
+	// compressedChunks counts chunks stored compressed, keyed by codec
+	compressedChunks = expvar.NewMap("upload_chunks_compressed")
+
+	committedPacks     = expvar.NewInt("upload_packs_committed")
+	commitRetries      = expvar.NewInt("upload_pack_commit_retries")
+	deadLetteredChunks = expvar.NewInt("upload_chunks_dead_lettered")
+
+	gcRuns          = expvar.NewInt("gc_runs")
+	gcChunksDeleted = expvar.NewInt("gc_chunks_deleted")
+	gcPacksDeleted  = expvar.NewInt("gc_packs_deleted")
+
+	compactPacksRewritten = expvar.NewInt("compact_packs_rewritten")
+	compactBytesReclaimed = expvar.NewInt("compact_bytes_reclaimed")
+	compactPacksRetired   = expvar.NewInt("compact_packs_retired")
+	compactChunksResealed = expvar.NewInt("compact_chunks_reencrypted")
+)
+
+// defaultAdminAddr only accepts connections from the same host
+const defaultAdminAddr = "127.0.0.1:3100"
+
+// StartAdminServer serves /debug/vars on ADMIN_ADDR. expvar also publishes
+// the command line and memory stats, so it is kept off the public listener.
+func StartAdminServer() {
+	addr := os.Getenv("ADMIN_ADDR")
+	if addr == "" {
+		addr = defaultAdminAddr
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /debug/vars", expvar.Handler())
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Fatalf("Admin server failed: %v", err)
+		}
+	}()
+	log.Printf("Serving metrics on http://%s/debug/vars", addr)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"sync"
+)
+
+// Deduplicating against a stored chunk only takes its SHA, and the download
+// service hands out chunks by SHA, so without a check knowing a hash would be
+// as good as having the data. When a have-list names chunks the index already
+// holds, the server therefore challenges the client for each of them: a random
+// nonce and a few random byte ranges of the chunk, answered with
+//
+//	hex(SHA-256(nonce || bytes of range 1 || bytes of range 2 || ...))
+//
+// Chunks without a correct answer are treated as missing and have to be
+// uploaded. Chunks the client sent on the same connection need no proof.
+//
+// Uploaded and proven chunks are granted to the user (see grants.go), and the
+// backend only registers recipes whose chunks the user holds grants for, so
+// a hash cannot be turned into a download by naming it in a recipe either.
+const (
+	proofRanges   = 4
+	proofRangeLen = 64
+	proofNonceLen = 16
+)
+
+// OwnershipChallenge asks for proof that the client holds a chunk. Ranges are
+// [start, end) offsets into the chunk's content.
+type OwnershipChallenge struct {
+	SHA    string   `json:"sha"`
+	Nonce  string   `json:"nonce"`
+	Ranges [][2]int `json:"ranges"`
+}
+
+type OwnershipProof struct {
+	SHA   string `json:"sha"`
+	Proof string `json:"proof"`
+}
+
+var requireOwnershipProof = true
+
+// InitOwnershipProof reads OWNERSHIP_PROOF (on or off). Turning it off lets
+// anyone who knows a chunk's SHA reference it; only do so for single tenant
+// deployments.
+func InitOwnershipProof() {
+	switch v := os.Getenv("OWNERSHIP_PROOF"); v {
+	case "", "on":
+		requireOwnershipProof = true
+	case "off":
+		requireOwnershipProof = false
+		log.Println("Ownership proofs are off, clients can deduplicate against any SHA they name")
+	default:
+		log.Fatalf("Invalid OWNERSHIP_PROOF %q (expected on or off)", v)
+	}
+}
+
+// newChallenges challenges the client for every SHA in existing, in order.
+// SHAs that left the domain's index since the have-list was checked are
+// returned in gone and have to be uploaded.
+func newChallenges(domain string, existing []string) ([]OwnershipChallenge, []string, error) {
+	keys := make([]string, len(existing))
+	for i, sha := range existing {
+		keys[i] = chunkKey(domain, sha)
+	}
+	metas, err := Index.Get(ctx, keys)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to look up existing chunks: %v", err)
+	}
+
+	challenges := []OwnershipChallenge{}
+	gone := []string{}
+	for _, sha := range existing {
+		meta, ok := metas[chunkKey(domain, sha)]
+		if !ok {
+			gone = append(gone, sha)
+			continue
+		}
+
+		nonce := make([]byte, proofNonceLen)
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, nil, err
+		}
+		c := OwnershipChallenge{SHA: sha, Nonce: hex.EncodeToString(nonce), Ranges: [][2]int{}}
+
+		size := storedChunkSize(meta)
+		length := min(proofRangeLen, size)
+		for i := 0; i < proofRanges && length > 0; i++ {
+			start, err := rand.Int(rand.Reader, big.NewInt(int64(size-length+1)))
+			if err != nil {
+				return nil, nil, err
+			}
+			c.Ranges = append(c.Ranges, [2]int{int(start.Int64()), int(start.Int64()) + length})
+		}
+		challenges = append(challenges, c)
+	}
+	return challenges, gone, nil
+}
+
+// checkProofs answers a proof message. Every pending challenge is settled,
+// answered or not; the SHAs that were not proven are returned as still needed.
+// Proven chunks are touched like any other deduplicated chunk and granted to
+// the user.
+func checkProofs(user, domain string, pending map[string]OwnershipChallenge, proofs []OwnershipProof) []string {
+	answers := make(map[string]string, len(proofs))
+	for _, p := range proofs {
+		answers[p.SHA] = p.Proof
+	}
+
+	need := []string{}
+	var answered []OwnershipChallenge
+	for sha, c := range pending {
+		delete(pending, sha)
+		if _, ok := answers[sha]; ok {
+			answered = append(answered, c)
+		} else {
+			ownershipProofs.Add("failed", 1)
+			need = append(need, sha)
+		}
+	}
+
+	passed, err := checkProofBatch(domain, answered, answers)
+	if err != nil {
+		log.Printf("Failed to check ownership proofs: %v", err)
+	}
+	var proven []string
+	for i, c := range answered {
+		if !passed[i] {
+			ownershipProofs.Add("failed", 1)
+			need = append(need, c.SHA)
+			continue
+		}
+		ownershipProofs.Add("passed", 1)
+		proven = append(proven, c.SHA)
+	}
+
+	touchChunks(domain, proven)
+	grantChunks(user, domain, proven)
+	return need
+}
+
+// proofReads bounds how many challenged chunks one proof message reads from
+// the blob store at once
+const proofReads = 8
+
+// checkProofBatch checks the answers to challenges, looking all of them up
+// in the index at once and reading their chunks concurrently. A chunk that
+// cannot be read fails its proof.
+func checkProofBatch(domain string, challenges []OwnershipChallenge, answers map[string]string) ([]bool, error) {
+	passed := make([]bool, len(challenges))
+	if len(challenges) == 0 {
+		return passed, nil
+	}
+
+	keys := make([]string, len(challenges))
+	for i, c := range challenges {
+		keys[i] = chunkKey(domain, c.SHA)
+	}
+	metas, err := Index.Get(ctx, keys)
+	if err != nil {
+		return passed, err
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(challenges))
+	slots := make(chan struct{}, proofReads)
+	for i, c := range challenges {
+		meta, ok := metas[keys[i]]
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			passed[i], errs[i] = checkProof(c, meta, answers[c.SHA])
+			if errs[i] != nil {
+				errs[i] = fmt.Errorf("%s: %v", c.SHA, errs[i])
+			}
+		}()
+	}
+	wg.Wait()
+	return passed, errors.Join(errs...)
+}
+
+func checkProof(c OwnershipChallenge, meta ChunkMeta, answer string) (bool, error) {
+	data, err := readChunk(c.SHA, meta)
+	if err != nil {
+		return false, err
+	}
+
+	nonce, err := hex.DecodeString(c.Nonce)
+	if err != nil {
+		return false, err
+	}
+	h := sha256.New()
+	h.Write(nonce)
+	for _, r := range c.Ranges {
+		if r[0] < 0 || r[1] > len(data) || r[0] > r[1] {
+			return false, fmt.Errorf("range %v is outside the chunk", r)
+		}
+		h.Write(data[r[0]:r[1]])
+	}
+	want := hex.EncodeToString(h.Sum(nil))
+	return subtle.ConstantTimeCompare([]byte(want), []byte(answer)) == 1, nil
+}
+
+// storedChunkSize is the length of a chunk's content. Chunks packed before
+// compression existed have no Size and are stored as they are.
+func storedChunkSize(meta ChunkMeta) int {
+	if meta.Size > 0 {
+		return meta.Size
+	}
+	return meta.End - meta.Start + 1
+}
+
+// readChunk fetches a chunk from its pack and returns its content
+func readChunk(sha string, meta ChunkMeta) ([]byte, error) {
+	stored, err := Blobs.GetRange(ctx, meta.Filename, int64(meta.Start), int64(meta.End))
+	if err != nil {
+		return nil, err
+	}
+	if len(stored) != meta.End-meta.Start+1 {
+		return nil, fmt.Errorf("short read of %s %d-%d", meta.Filename, meta.Start, meta.End)
+	}
+	plain, err := openChunk(sha, meta.KeyID, stored)
+	if err != nil {
+		return nil, err
+	}
+	return decodeChunk(codecByName(meta.Codec), plain, storedChunkSize(meta))
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+// answerChallenge proves ownership of data the way the client does
+func answerChallenge(c OwnershipChallenge, data []byte) string {
+	nonce, _ := hex.DecodeString(c.Nonce)
+	h := sha256.New()
+	h.Write(nonce)
+	for _, r := range c.Ranges {
+		h.Write(data[r[0]:r[1]])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// storeChunks packs raw chunks back to back into one blob and indexes them
+func storeChunks(t *testing.T, domain string, chunks [][]byte) []string {
+	t.Helper()
+	var pack []byte
+	metas := make(map[string]ChunkMeta)
+	var shas []string
+	for i, data := range chunks {
+		sha := shaOf(data)
+		metas[chunkKey(domain, sha)] = ChunkMeta{Filename: "pack", Start: len(pack), End: len(pack) + len(data) - 1, No: i + 1, Seen: 1}
+		pack = append(pack, data...)
+		shas = append(shas, sha)
+	}
+	Blobs.Put(ctx, "pack", bytes.NewReader(pack))
+	if err := Index.PutBatch(ctx, metas); err != nil {
+		t.Fatal(err)
+	}
+	return shas
+}
+
+func useTestStores(t *testing.T) {
+	t.Helper()
+	keys, blobs, index, grants := Keys, Blobs, Index, Grants
+	t.Cleanup(func() { Keys, Blobs, Index, Grants = keys, blobs, index, grants })
+
+	Keys = nil
+	Blobs = NewMemoryBlobStore()
+	Index, _ = NewMemoryChunkIndex("")
+	Grants = NewMemoryOwnershipGrants()
+}
+
+func TestCheckProofs(t *testing.T) {
+	useTestStores(t)
+	const domain = "user-1"
+
+	var chunks [][]byte
+	for i := 0; i < 3*proofReads; i++ {
+		chunks = append(chunks, []byte(strings.Repeat(fmt.Sprintf("chunk %d ", i), 20+i)))
+	}
+	shas := storeChunks(t, domain, chunks)
+
+	challenges, gone, err := newChallenges(domain, append(shas, testSHA(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gone, []string{testSHA(1)}) {
+		t.Errorf("gone is %v, want the SHA the index lacks", gone)
+	}
+	if len(challenges) != len(shas) {
+		t.Fatalf("%d challenges for %d stored chunks", len(challenges), len(shas))
+	}
+
+	// Answer all but the first two: one wrong, one not at all
+	pending := make(map[string]OwnershipChallenge)
+	var proofs []OwnershipProof
+	for i, c := range challenges {
+		pending[c.SHA] = c
+		switch i {
+		case 0:
+			proofs = append(proofs, OwnershipProof{SHA: c.SHA, Proof: answerChallenge(c, bytes.Repeat([]byte("x"), len(chunks[i])))})
+		case 1:
+		default:
+			proofs = append(proofs, OwnershipProof{SHA: c.SHA, Proof: answerChallenge(c, chunks[i])})
+		}
+	}
+
+	need := checkProofs("alice", domain, pending, proofs)
+	sort.Strings(need)
+	want := []string{shas[0], shas[1]}
+	sort.Strings(want)
+	if !reflect.DeepEqual(need, want) {
+		t.Errorf("need %v after proofs, want the two unproven chunks", need)
+	}
+	if len(pending) != 0 {
+		t.Errorf("%d challenges left pending", len(pending))
+	}
+
+	keys := make([]string, len(shas))
+	for i, sha := range shas {
+		keys[i] = chunkKey(domain, sha)
+	}
+	missing, err := Grants.Missing(ctx, "alice", keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(missing, keys[:2]) {
+		t.Errorf("alice lacks grants for %v, want only the unproven chunks", missing)
+	}
+	if missing, _ := Grants.Missing(ctx, "mallory", keys); len(missing) != len(keys) {
+		t.Errorf("proofs were granted to another user")
+	}
+}
+
+func TestOwnershipGrants(t *testing.T) {
+	mr := miniredis.RunT(t)
+	backends := map[string]OwnershipGrants{
+		"memory": NewMemoryOwnershipGrants(),
+		"redis":  NewRedisOwnershipGrants(redis.NewClient(&redis.Options{Addr: mr.Addr()})),
+	}
+	for name, grants := range backends {
+		t.Run(name, func(t *testing.T) {
+			a, b, c := chunkKey("", testSHA(1)), chunkKey("org-x", testSHA(1)), chunkKey("", testSHA(2))
+			if err := grants.Grant(ctx, "alice", []string{a, b}); err != nil {
+				t.Fatal(err)
+			}
+
+			missing, err := grants.Missing(ctx, "alice", []string{a, b, c})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(missing, []string{c}) {
+				t.Errorf("alice lacks %v, want %v", missing, []string{c})
+			}
+			missing, err = grants.Missing(ctx, "bob", []string{a})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(missing, []string{a}) {
+				t.Errorf("bob lacks %v, want %v", missing, []string{a})
+			}
+		})
+	}
+
+	// Grants lapse after ownershipGrantTTL
+	memory := backends["memory"].(*MemoryOwnershipGrants)
+	memory.grants["alice"][chunkKey("", testSHA(1))] = time.Now().Add(-time.Second)
+	if missing, _ := memory.Missing(ctx, "alice", []string{chunkKey("", testSHA(1))}); len(missing) != 1 {
+		t.Error("expired grant still counts")
+	}
+}
+
+func TestCheckRecipe(t *testing.T) {
+	useTestStores(t)
+	defer func(keyfunc jwt.Keyfunc, methods []string) { jwtKeyfunc, jwtMethods = keyfunc, methods }(jwtKeyfunc, jwtMethods)
+	secret := []byte("test secret")
+	jwtKeyfunc = func(*jwt.Token) (interface{}, error) { return secret, nil }
+	jwtMethods = []string{"HS256"}
+
+	mixed := shaOf([]byte("a SHA with letters"))
+	grantChunks("alice", "", []string{testSHA(1), testSHA(2), mixed})
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/recipes/check", handleCheckRecipe)
+
+	check := func(user string, body string) (int, RecipeCheck) {
+		req := httptest.NewRequest(http.MethodPost, "/recipes/check", strings.NewReader(body))
+		if user != "" {
+			token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+				"id":  user,
+				"exp": time.Now().Add(time.Hour).Unix(),
+			}).SignedString(secret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var res RecipeCheck
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return w.Code, res
+	}
+
+	tests := []struct {
+		name    string
+		user    string
+		shas    []string
+		status  int
+		missing []string
+	}{
+		{"all granted", "alice", []string{testSHA(1), testSHA(2), testSHA(1)}, http.StatusOK, []string{}},
+		{"upper case", "alice", []string{strings.ToUpper(mixed)}, http.StatusOK, []string{}},
+		{"one not granted", "alice", []string{testSHA(1), testSHA(3)}, http.StatusOK, []string{testSHA(3)}},
+		{"granted to someone else", "mallory", []string{testSHA(1)}, http.StatusOK, []string{testSHA(1)}},
+		{"invalid sha", "alice", []string{"abc"}, http.StatusBadRequest, nil},
+		{"no token", "", []string{testSHA(1)}, http.StatusUnauthorized, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(RecipeCheck{SHAs: tt.shas})
+			status, res := check(tt.user, string(body))
+			if status != tt.status {
+				t.Fatalf("status %d, want %d", status, tt.status)
+			}
+			if tt.status == http.StatusOK && !reflect.DeepEqual(res.Missing, tt.missing) {
+				t.Errorf("missing %v, want %v", res.Missing, tt.missing)
+			}
+			if res.Domain != "" {
+				t.Errorf("recipe is in domain %q, want the global one", res.Domain)
+			}
+		})
+	}
+
+	// The answer names the caller's domain for the backend to record, and
+	// grants only count in the domain they were made in
+	defer func(mode string) { dedupDomainMode = mode }(dedupDomainMode)
+	dedupDomainMode = DomainUser
+	body, _ := json.Marshal(RecipeCheck{SHAs: []string{testSHA(1)}})
+	if _, res := check("alice", string(body)); res.Domain != "user-alice" || len(res.Missing) != 1 {
+		t.Errorf("check in user domain answered %+v", res)
+	}
+	grantChunks("alice", "user-alice", []string{testSHA(1)})
+	if _, res := check("alice", string(body)); res.Domain != "user-alice" || len(res.Missing) != 0 {
+		t.Errorf("check in user domain answered %+v", res)
+	}
+}
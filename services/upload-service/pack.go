@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// Packs are self-describing so they can be verified, and the chunk index
+// rebuilt, from the blob store alone:
+//
+//	header:  "NSPK" | version u8
+//	records: chunk bytes as stored (see codec.go and keys.go), back to back
+//	index:   repeated: sha [32]byte | offset u64 | length u32 | raw length u32 |
+//	                   codec u8 | chunk_no u32 | crc32 u32 |
+//	                   key id length u8 | key id (version 2 only)
+//	footer:  index offset u64 | entry count u32 | index crc32 u32 |
+//	         "NSPK" (version 1) or "NSP2" (version 2)
+//
+// All integers are big endian. Offsets are from the start of the pack and
+// ChunkMeta.Start/End point straight at a record, so readers that only know
+// the index never need to parse the pack. The per-record crc32 covers the
+// stored bytes and the footer crc32 covers the whole index. New packs are
+// always written as version 2; version 1 packs stay readable.
+const (
+	packMagic   = "NSPK"
+	packVersion = 2
+
+	packHeaderSize   = len(packMagic) + 1
+	packEntryV1Size  = 32 + 8 + 4 + 4 + 1 + 4 + 4
+	packFooterSize   = 8 + 4 + 4 + len(packMagic)
+	packFooterMagic2 = "NSP2"
+)
+
+// Codecs a pack record can be stored with, see codec.go for the others
+const (
+	CodecNone uint8 = 0
+)
+
+// ErrNotAPack is returned for objects without a pack footer, such as packs
+// written before the format was versioned
+var ErrNotAPack = errors.New("object is not a NeuroStore pack")
+
+type PackEntry struct {
+	SHA       string
+	Offset    int64
+	Length    uint32 // stored bytes
+	RawLength uint32 // bytes after decoding
+	Codec     uint8
+	ChunkNo   int
+	CRC       uint32
+	KeyID     string // encryption key, empty for plaintext records
+}
+
+// End is the inclusive offset of the last stored byte, as used by ChunkMeta
+func (e PackEntry) End() int64 {
+	return e.Offset + int64(e.Length) - 1
+}
+
+// Meta is the chunk index entry for a record in the pack stored at key
+func (e PackEntry) Meta(key string) ChunkMeta {
+	return ChunkMeta{
+		Filename: key,
+		Start:    int(e.Offset),
+		End:      int(e.End()),
+		No:       e.ChunkNo,
+		Codec:    codecName(e.Codec),
+		Size:     int(e.RawLength),
+		KeyID:    e.KeyID,
+	}
+}
+
+// PackWriter builds a pack in memory
+type PackWriter struct {
+	buf     bytes.Buffer
+	entries []PackEntry
+}
+
+func NewPackWriter() *PackWriter {
+	w := &PackWriter{}
+	w.buf.WriteString(packMagic)
+	w.buf.WriteByte(packVersion)
+	return w
+}
+
+// Add appends a record. The caller fills in SHA, ChunkNo, RawLength, Codec
+// and KeyID; the complete index entry is returned.
+func (w *PackWriter) Add(entry PackEntry, data []byte) (PackEntry, error) {
+	if !isSHA256Hex(entry.SHA) {
+		return PackEntry{}, fmt.Errorf("invalid sha %q", entry.SHA)
+	}
+	if len(entry.KeyID) > 255 {
+		return PackEntry{}, fmt.Errorf("key id %q is too long", entry.KeyID)
+	}
+
+	entry.Offset = int64(w.buf.Len())
+	entry.Length = uint32(len(data))
+	entry.CRC = crc32.ChecksumIEEE(data)
+	w.buf.Write(data)
+	w.entries = append(w.entries, entry)
+	return entry, nil
+}
+
+func (w *PackWriter) Len() int {
+	return len(w.entries)
+}
+
+// Finish writes the index and footer and returns the complete pack
+func (w *PackWriter) Finish() []byte {
+	indexOffset := w.buf.Len()
+	index := encodePackIndex(w.entries)
+	w.buf.Write(index)
+
+	binary.Write(&w.buf, binary.BigEndian, uint64(indexOffset))
+	binary.Write(&w.buf, binary.BigEndian, uint32(len(w.entries)))
+	binary.Write(&w.buf, binary.BigEndian, crc32.ChecksumIEEE(index))
+	w.buf.WriteString(packFooterMagic2)
+
+	return w.buf.Bytes()
+}
+
+func encodePackIndex(entries []PackEntry) []byte {
+	var buf bytes.Buffer
+	for _, e := range entries {
+		sha, _ := hex.DecodeString(e.SHA)
+		buf.Write(sha)
+		binary.Write(&buf, binary.BigEndian, uint64(e.Offset))
+		binary.Write(&buf, binary.BigEndian, e.Length)
+		binary.Write(&buf, binary.BigEndian, e.RawLength)
+		buf.WriteByte(e.Codec)
+		binary.Write(&buf, binary.BigEndian, uint32(e.ChunkNo))
+		binary.Write(&buf, binary.BigEndian, e.CRC)
+		buf.WriteByte(byte(len(e.KeyID)))
+		buf.WriteString(e.KeyID)
+	}
+	return buf.Bytes()
+}
+
+type packFooter struct {
+	version     int
+	indexOffset int64
+	count       int
+	indexCRC    uint32
+}
+
+func parsePackFooter(footer []byte, size int64) (packFooter, error) {
+	if len(footer) != packFooterSize {
+		return packFooter{}, ErrNotAPack
+	}
+
+	f := packFooter{
+		indexOffset: int64(binary.BigEndian.Uint64(footer[0:8])),
+		count:       int(binary.BigEndian.Uint32(footer[8:12])),
+		indexCRC:    binary.BigEndian.Uint32(footer[12:16]),
+	}
+	switch string(footer[packFooterSize-len(packMagic):]) {
+	case packMagic:
+		f.version = 1
+	case packFooterMagic2:
+		f.version = 2
+	default:
+		return packFooter{}, ErrNotAPack
+	}
+
+	indexEnd := size - int64(packFooterSize)
+	minIndex := int64(f.count) * int64(packEntryV1Size)
+	if f.version == 2 {
+		minIndex += int64(f.count)
+	}
+	if f.indexOffset < int64(packHeaderSize) || indexEnd-f.indexOffset < minIndex ||
+		(f.version == 1 && indexEnd-f.indexOffset != minIndex) {
+		return packFooter{}, fmt.Errorf("pack footer does not match object size %d", size)
+	}
+	return f, nil
+}
+
+func parsePackIndex(index []byte, f packFooter) ([]PackEntry, error) {
+	if crc32.ChecksumIEEE(index) != f.indexCRC {
+		return nil, errors.New("pack index checksum mismatch")
+	}
+
+	entries := make([]PackEntry, 0, f.count)
+	for i := 0; i < f.count; i++ {
+		if len(index) < packEntryV1Size {
+			return nil, errors.New("pack index is truncated")
+		}
+		b := index[:packEntryV1Size]
+		index = index[packEntryV1Size:]
+
+		e := PackEntry{
+			SHA:       hex.EncodeToString(b[0:32]),
+			Offset:    int64(binary.BigEndian.Uint64(b[32:40])),
+			Length:    binary.BigEndian.Uint32(b[40:44]),
+			RawLength: binary.BigEndian.Uint32(b[44:48]),
+			Codec:     b[48],
+			ChunkNo:   int(binary.BigEndian.Uint32(b[49:53])),
+			CRC:       binary.BigEndian.Uint32(b[53:57]),
+		}
+		if f.version >= 2 {
+			if len(index) < 1 || len(index) < 1+int(index[0]) {
+				return nil, errors.New("pack index is truncated")
+			}
+			e.KeyID = string(index[1 : 1+int(index[0])])
+			index = index[1+int(index[0]):]
+		}
+		if e.Offset < int64(packHeaderSize) || e.Offset+int64(e.Length) > f.indexOffset {
+			return nil, fmt.Errorf("pack entry %s points outside the record area", e.SHA)
+		}
+		entries = append(entries, e)
+	}
+	if len(index) != 0 {
+		return nil, errors.New("pack index has trailing bytes")
+	}
+	return entries, nil
+}
+
+// ReadPackIndex fetches only the footer and index of a stored pack
+func ReadPackIndex(ctx context.Context, store BlobStore, key string, size int64) ([]PackEntry, error) {
+	if size < int64(packHeaderSize+packFooterSize) {
+		return nil, ErrNotAPack
+	}
+
+	footer, err := store.GetRange(ctx, key, size-int64(packFooterSize), size-1)
+	if err != nil {
+		return nil, err
+	}
+	f, err := parsePackFooter(footer, size)
+	if err != nil {
+		return nil, err
+	}
+	if f.count == 0 {
+		return nil, nil
+	}
+
+	index, err := store.GetRange(ctx, key, f.indexOffset, size-int64(packFooterSize)-1)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(index)) != size-int64(packFooterSize)-f.indexOffset {
+		return nil, fmt.Errorf("short read of pack index for %s", key)
+	}
+	return parsePackIndex(index, f)
+}
+
+// VerifyPack checks a whole pack: header, footer, index and every record's
+// crc32, then decodes each record and checks its SHA-256. Encrypted records
+// are only decoded when their key is available.
+func VerifyPack(pack []byte) ([]PackEntry, error) {
+	size := int64(len(pack))
+	if size < int64(packHeaderSize+packFooterSize) || string(pack[:len(packMagic)]) != packMagic {
+		return nil, ErrNotAPack
+	}
+	f, err := parsePackFooter(pack[size-int64(packFooterSize):], size)
+	if err != nil {
+		return nil, err
+	}
+	if int(pack[len(packMagic)]) != f.version {
+		return nil, fmt.Errorf("pack header says version %d, footer says %d", pack[len(packMagic)], f.version)
+	}
+	entries, err := parsePackIndex(pack[f.indexOffset:size-int64(packFooterSize)], f)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		record := pack[e.Offset : e.Offset+int64(e.Length)]
+		if crc32.ChecksumIEEE(record) != e.CRC {
+			return nil, fmt.Errorf("record %s failed its checksum", e.SHA)
+		}
+		if e.KeyID != "" && Keys == nil {
+			continue
+		}
+		raw, err := openRecord(e, record)
+		if err != nil {
+			return nil, fmt.Errorf("record %s: %v", e.SHA, err)
+		}
+		sum := sha256.Sum256(raw)
+		if hex.EncodeToString(sum[:]) != e.SHA {
+			return nil, fmt.Errorf("record %s does not match its sha", e.SHA)
+		}
+	}
+	return entries, nil
+}
+
+// openRecord decrypts and decodes a stored record back into chunk content
+func openRecord(e PackEntry, record []byte) ([]byte, error) {
+	plain, err := openChunk(e.SHA, e.KeyID, record)
+	if err != nil {
+		return nil, err
+	}
+	return decodeChunk(e.Codec, plain, int(e.RawLength))
+}
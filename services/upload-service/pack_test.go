@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func shaOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// testPack packs a compressible and an incompressible chunk and an empty one
+func testPack(t *testing.T) ([]byte, []PackEntry, [][]byte) {
+	t.Helper()
+	random := make([]byte, 5000)
+	rand.New(rand.NewSource(1)).Read(random)
+	raws := [][]byte{
+		[]byte(strings.Repeat("compressible ", 500)),
+		random,
+		{},
+	}
+
+	w := NewPackWriter()
+	var entries []PackEntry
+	for i, raw := range raws {
+		stored, codec := compressChunk(raw)
+		e, err := w.Add(PackEntry{SHA: shaOf(raw), ChunkNo: i + 1, RawLength: uint32(len(raw)), Codec: codec}, stored)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	return w.Finish(), entries, raws
+}
+
+// repack rebuilds the index and footer of a pack around its records
+func repack(pack []byte, entries []PackEntry, indexOffset int) []byte {
+	out := bytes.Clone(pack[:indexOffset])
+	index := encodePackIndex(entries)
+	out = append(out, index...)
+	out = binary.BigEndian.AppendUint64(out, uint64(indexOffset))
+	out = binary.BigEndian.AppendUint32(out, uint32(len(entries)))
+	out = binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(index))
+	return append(out, packFooterMagic2...)
+}
+
+func TestPackRoundTrip(t *testing.T) {
+	pack, written, raws := testPack(t)
+	if written[0].Codec != chunkCodec || written[1].Codec != CodecNone {
+		t.Errorf("chunks stored with codecs %d and %d", written[0].Codec, written[1].Codec)
+	}
+
+	entries, err := VerifyPack(pack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(entries, written) {
+		t.Fatalf("index is %+v, want %+v", entries, written)
+	}
+	for i, e := range entries {
+		raw, err := openRecord(e, pack[e.Offset:e.End()+1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(raw, raws[i]) {
+			t.Errorf("record %d does not decode to its chunk", i)
+		}
+	}
+
+	store := NewMemoryBlobStore()
+	store.Put(context.Background(), "pack", bytes.NewReader(pack))
+	indexed, err := ReadPackIndex(context.Background(), store, "pack", int64(len(pack)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(indexed, written) {
+		t.Fatalf("stored index is %+v, want %+v", indexed, written)
+	}
+}
+
+func TestPackVersion1(t *testing.T) {
+	raw := []byte("a chunk in a version 1 pack")
+	pack := append([]byte(packMagic), 1)
+	pack = append(pack, raw...)
+
+	sha, _ := hex.DecodeString(shaOf(raw))
+	var index []byte
+	index = append(index, sha...)
+	index = binary.BigEndian.AppendUint64(index, uint64(packHeaderSize))
+	index = binary.BigEndian.AppendUint32(index, uint32(len(raw)))
+	index = binary.BigEndian.AppendUint32(index, uint32(len(raw)))
+	index = append(index, CodecNone)
+	index = binary.BigEndian.AppendUint32(index, 1)
+	index = binary.BigEndian.AppendUint32(index, crc32.ChecksumIEEE(raw))
+
+	indexOffset := len(pack)
+	pack = append(pack, index...)
+	pack = binary.BigEndian.AppendUint64(pack, uint64(indexOffset))
+	pack = binary.BigEndian.AppendUint32(pack, 1)
+	pack = binary.BigEndian.AppendUint32(pack, crc32.ChecksumIEEE(index))
+	pack = append(pack, packMagic...)
+
+	entries, err := VerifyPack(pack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PackEntry{{
+		SHA:       shaOf(raw),
+		Offset:    int64(packHeaderSize),
+		Length:    uint32(len(raw)),
+		RawLength: uint32(len(raw)),
+		ChunkNo:   1,
+		CRC:       crc32.ChecksumIEEE(raw),
+	}}
+	if !reflect.DeepEqual(entries, want) {
+		t.Fatalf("index is %+v, want %+v", entries, want)
+	}
+}
+
+func TestVerifyPackRejects(t *testing.T) {
+	good, entries, _ := testPack(t)
+	size := len(good)
+	indexOffset := int(binary.BigEndian.Uint64(good[size-packFooterSize:]))
+	footer := size - packFooterSize
+
+	tests := []struct {
+		name   string
+		mutate func(p []byte) []byte
+		notA   bool // expect ErrNotAPack
+	}{
+		{"empty", func(p []byte) []byte { return nil }, true},
+		{"header only", func(p []byte) []byte { return p[:packHeaderSize] }, true},
+		{"no header magic", func(p []byte) []byte { p[0] = 'X'; return p }, true},
+		{"no footer magic", func(p []byte) []byte { p[size-1] = 'X'; return p }, true},
+		{"truncated", func(p []byte) []byte { return p[:size-1] }, true},
+		{"header version differs", func(p []byte) []byte { p[len(packMagic)] = 1; return p }, false},
+		{"index offset past end", func(p []byte) []byte {
+			binary.BigEndian.PutUint64(p[footer:], uint64(size))
+			return p
+		}, false},
+		{"index offset in header", func(p []byte) []byte {
+			binary.BigEndian.PutUint64(p[footer:], 1)
+			return p
+		}, false},
+		{"too many entries", func(p []byte) []byte {
+			binary.BigEndian.PutUint32(p[footer+8:], uint32(len(entries)+1))
+			return p
+		}, false},
+		{"index checksum", func(p []byte) []byte { p[indexOffset+40] ^= 1; return p }, false},
+		{"footer checksum", func(p []byte) []byte { p[footer+12] ^= 1; return p }, false},
+		{"record checksum", func(p []byte) []byte { p[entries[1].Offset] ^= 1; return p }, false},
+		{"entry outside records", func(p []byte) []byte {
+			bad := append([]PackEntry(nil), entries...)
+			bad[1].Offset = int64(indexOffset)
+			return repack(p, bad, indexOffset)
+		}, false},
+		{"record does not match sha", func(p []byte) []byte {
+			bad := append([]PackEntry(nil), entries...)
+			bad[1].SHA = entries[0].SHA
+			return repack(p, bad, indexOffset)
+		}, false},
+		{"trailing index bytes", func(p []byte) []byte {
+			// One more byte in the index than its entries account for
+			index := append(encodePackIndex(entries), 0)
+			out := append(bytes.Clone(p[:indexOffset]), index...)
+			out = binary.BigEndian.AppendUint64(out, uint64(indexOffset))
+			out = binary.BigEndian.AppendUint32(out, uint32(len(entries)))
+			out = binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(index))
+			return append(out, packFooterMagic2...)
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := VerifyPack(tt.mutate(bytes.Clone(good)))
+			if err == nil {
+				t.Fatal("damaged pack was accepted")
+			}
+			if tt.notA != errors.Is(err, ErrNotAPack) {
+				t.Errorf("got %v", err)
+			}
+		})
+	}
+}
+
+func TestPackWriterRejects(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry PackEntry
+	}{
+		{"no sha", PackEntry{}},
+		{"sha not hex", PackEntry{SHA: strings.Repeat("z", 64)}},
+		{"long key id", PackEntry{SHA: shaOf(nil), KeyID: strings.Repeat("k", 256)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewPackWriter().Add(tt.entry, nil); err == nil {
+				t.Error("entry was added")
+			}
+		})
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"log"
+	"os"
 	"sync"
 	"time"
 )
@@ -11,6 +13,9 @@ type ConcurrentChunkDeque struct {
 	totalChunks   int
 	lock          sync.Mutex
 	lastflushtime time.Time
+
+	// wal makes queued chunks survive a restart, see InitIngestQueue
+	wal *IngestLog
 }
 
 func NewConcurrentChunkDeque() *ConcurrentChunkDeque {
@@ -20,18 +25,77 @@ func NewConcurrentChunkDeque() *ConcurrentChunkDeque {
 	}
 }
 
-func (q *ConcurrentChunkDeque) EnqueueBack(chunkSlice []Chunk) {
+// ingestWALDir is INGEST_WAL_DIR, the upload service's persistent state
+// directory
+func ingestWALDir() string {
+	if dir := os.Getenv("INGEST_WAL_DIR"); dir != "" {
+		return dir
+	}
+	return "ingest-wal"
+}
+
+// InitIngestQueue backs globalQueue with the write-ahead log in INGEST_WAL_DIR
+// and requeues whatever a previous run left uncommitted
+func InitIngestQueue() {
+	dir := ingestWALDir()
+
+	wal, err := OpenIngestLog(dir)
+	if err != nil {
+		log.Fatalf("Failed to open ingest WAL: %v", err)
+	}
+	batches, err := wal.Replay()
+	if err != nil {
+		log.Fatalf("Failed to replay ingest WAL: %v", err)
+	}
+
+	globalQueue.lock.Lock()
+	globalQueue.wal = wal
+	for _, batch := range batches {
+		globalQueue.queue = append(globalQueue.queue, batch)
+		globalQueue.totalChunks += len(batch)
+	}
+	replayed := globalQueue.totalChunks
+	globalQueue.lock.Unlock()
+
+	log.Printf("Ingest WAL at %s replayed %d chunks", dir, replayed)
+}
+
+// EnqueueBack returns once the chunks are durable; the caller may only
+// acknowledge them to a client after it returns nil
+func (q *ConcurrentChunkDeque) EnqueueBack(chunkSlice []Chunk) error {
+	if q.wal != nil {
+		if err := q.wal.Append(chunkSlice); err != nil {
+			return err
+		}
+	}
+
 	q.lock.Lock()
 	defer q.lock.Unlock()
 	q.queue = append(q.queue, chunkSlice)
 	q.totalChunks += len(chunkSlice)
+	return nil
 }
 
-func (q *ConcurrentChunkDeque) EnqueueFront(chunkSlice []Chunk) {
+func (q *ConcurrentChunkDeque) EnqueueFront(chunkSlice []Chunk) error {
+	if q.wal != nil {
+		if err := q.wal.Append(chunkSlice); err != nil {
+			return err
+		}
+	}
+
 	q.lock.Lock()
 	defer q.lock.Unlock()
 	q.queue = append([][]Chunk{chunkSlice}, q.queue...)
 	q.totalChunks += len(chunkSlice)
+	return nil
+}
+
+// Commit tells the WAL these chunks are packed and indexed and no longer need
+// to be replayed
+func (q *ConcurrentChunkDeque) Commit(chunks []Chunk) {
+	if q.wal != nil {
+		q.wal.Release(chunks)
+	}
 }
 
 func (q *ConcurrentChunkDeque) PopFront() ([]Chunk, bool) {
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+const rebuildBatchSize = 1000
+
+// rebuildIndex repopulates the chunk index from the index trailer of every
+// pack in the blob store. It is the recovery path when Redis is lost.
+//
+// Entries that are missing are written. An entry that points somewhere no pack
+// index agrees with is a conflict: it is replaced by what the packs say,
+// unless it points at a pack that could not be read (such as one written
+// before packs had an index), in which case it is left alone. A SHA stored in
+// more than one pack of the same dedup domain is a duplicate; the first pack in
+// listing order wins.
+func rebuildIndex(args []string) {
+	fs := flag.NewFlagSet("rebuild-index", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "report what would change without writing to the index")
+	fs.Parse(args)
+
+	InitChunkIndex()
+	InitBlobStore()
+
+	packs, err := listPacks(ctx)
+	if err != nil {
+		log.Fatalf("Failed to list packs: %v", err)
+	}
+
+	// Packs replaced by compaction hold stale copies and are about to go
+	retiring, err := retiringPacks()
+	if err != nil {
+		log.Fatalf("Failed to read compaction journal: %v", err)
+	}
+
+	found := make(map[string]ChunkMeta)
+	unreadable := make(map[string]bool)
+	var order []string
+	duplicates := 0
+
+	for _, info := range packs {
+		if retiring[info.Key] {
+			fmt.Printf("skipped  %s: replaced by compaction\n", info.Key)
+			continue
+		}
+
+		entries, err := ReadPackIndex(ctx, Blobs, info.Key, info.Size)
+		if errors.Is(err, ErrNotAPack) {
+			fmt.Printf("skipped  %s: no pack index, its chunks cannot be recovered from storage\n", info.Key)
+			unreadable[info.Key] = true
+			continue
+		}
+		if err != nil {
+			fmt.Printf("failed   %s: %v\n", info.Key, err)
+			unreadable[info.Key] = true
+			continue
+		}
+
+		domain := packDomain(info.Key)
+		for _, e := range entries {
+			key := chunkKey(domain, e.SHA)
+			if prev, ok := found[key]; ok {
+				duplicates++
+				fmt.Printf("dup      %s in %s, keeping %s\n", key, info.Key, prev.Filename)
+				continue
+			}
+			found[key] = e.Meta(info.Key)
+			order = append(order, key)
+		}
+	}
+
+	// Entries written here count as seen now, so GC leaves them a full grace
+	// period; an upload in flight when the index was lost may not have its
+	// recipe registered yet
+	now := time.Now().Unix()
+	var written, unchanged, conflicts, kept int
+	for i := 0; i < len(order); i += rebuildBatchSize {
+		keys := order[i:min(i+rebuildBatchSize, len(order))]
+
+		current, err := Index.Get(ctx, keys)
+		if err != nil {
+			log.Fatalf("Failed to read chunk index: %v", err)
+		}
+
+		batch := make(map[string]ChunkMeta)
+		for _, key := range keys {
+			want := found[key]
+			have, ok := current[key]
+			want.Seen = have.Seen // not compared
+			switch {
+			case !ok:
+				want.Seen = now
+				batch[key] = want
+			case have == want:
+				unchanged++
+			case unreadable[have.Filename]:
+				kept++
+			default:
+				conflicts++
+				fmt.Printf("conflict %s: index has %s %d-%d, pack index has %s %d-%d\n",
+					key, have.Filename, have.Start, have.End, want.Filename, want.Start, want.End)
+				want.Seen = now
+				batch[key] = want
+			}
+		}
+
+		if !*dryRun {
+			if err := Index.PutBatch(ctx, batch); err != nil {
+				log.Fatalf("Failed to write chunk index after %d entries: %v", written, err)
+			}
+		}
+		written += len(batch)
+	}
+
+	verb := "Wrote"
+	if *dryRun {
+		verb = "Would write"
+	}
+	fmt.Printf("Scanned %d packs (%d unreadable), %d chunks: %s %d entries, %d unchanged, %d conflicts, %d duplicates, %d kept pointing at unreadable packs\n",
+		len(packs), len(unreadable), len(order), verb, written, unchanged, conflicts, duplicates, kept)
+
+	if len(unreadable) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"go.mongodb.org/mongo-driver/v2/x/mongo/driver/connstring"
+)
+
+// RecipeStore is the source of truth for which chunks are still in use: every
+// version of every file is a recipe listing its chunk SHAs and the dedup
+// domain they are stored in. The backend owns the recipes, the upload service
+// only reads them for GC. ReferencedChunks passes a nil domain for recipes
+// registered before the domain was recorded.
+type RecipeStore interface {
+	ReferencedChunks(ctx context.Context, fn func(domain *string, sha string)) error
+}
+
+// MongoRecipeStore reads the backend's collections: files point at metadata
+// documents (one per version) and those list the chunks. Metadata documents
+// that no file points at any more do not keep their chunks alive.
+type MongoRecipeStore struct {
+	db *mongo.Database
+}
+
+var Recipes RecipeStore
+
+// InitRecipeStore connects to the backend's MongoDB at MONGO_URI. The
+// database is taken from the URI, like the backend does.
+func InitRecipeStore() {
+	uri := os.Getenv("MONGO_URI")
+	if uri == "" {
+		log.Fatal("MONGO_URI environment variable is not defined")
+	}
+
+	cs, err := connstring.ParseAndValidate(uri)
+	if err != nil {
+		log.Fatalf("Invalid MONGO_URI: %v", err)
+	}
+	dbName := cs.Database
+	if dbName == "" {
+		dbName = "test"
+	}
+
+	client, err := mongo.Connect(options.Client().ApplyURI(uri))
+	if err != nil {
+		log.Fatalf("Failed to connect to MongoDB: %v", err)
+	}
+
+	pingCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err := client.Ping(pingCtx, nil); err != nil {
+		log.Fatalf("Failed to reach MongoDB: %v", err)
+	}
+
+	Recipes = &MongoRecipeStore{db: client.Database(dbName)}
+	log.Printf("Reading file recipes from MongoDB database %s", dbName)
+}
+
+func (m *MongoRecipeStore) ReferencedChunks(ctx context.Context, fn func(domain *string, sha string)) error {
+	files, err := m.db.Collection("files").Find(ctx, bson.D{},
+		options.Find().SetProjection(bson.D{{Key: "metadata._id", Value: 1}}))
+	if err != nil {
+		return fmt.Errorf("failed to list files: %v", err)
+	}
+
+	var ids []bson.ObjectID
+	for files.Next(ctx) {
+		var file struct {
+			Metadata []struct {
+				ID bson.ObjectID `bson:"_id"`
+			} `bson:"metadata"`
+		}
+		if err := files.Decode(&file); err != nil {
+			files.Close(ctx)
+			return fmt.Errorf("failed to decode file: %v", err)
+		}
+		for _, v := range file.Metadata {
+			ids = append(ids, v.ID)
+		}
+	}
+	if err := files.Err(); err != nil {
+		files.Close(ctx)
+		return err
+	}
+	files.Close(ctx)
+
+	const batchSize = 500
+	for i := 0; i < len(ids); i += batchSize {
+		batch := ids[i:min(i+batchSize, len(ids))]
+		cur, err := m.db.Collection("metadata").Find(ctx,
+			bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: batch}}}},
+			options.Find().SetProjection(bson.D{{Key: "chunks.sha", Value: 1}, {Key: "domain", Value: 1}}))
+		if err != nil {
+			return fmt.Errorf("failed to read metadata: %v", err)
+		}
+
+		for cur.Next(ctx) {
+			var recipe struct {
+				Chunks []struct {
+					SHA string `bson:"sha"`
+				} `bson:"chunks"`
+				Domain *string `bson:"domain"`
+			}
+			if err := cur.Decode(&recipe); err != nil {
+				cur.Close(ctx)
+				return fmt.Errorf("failed to decode metadata: %v", err)
+			}
+			for _, c := range recipe.Chunks {
+				fn(recipe.Domain, strings.ToLower(c.SHA))
+			}
+		}
+		if err := cur.Err(); err != nil {
+			cur.Close(ctx)
+			return err
+		}
+		cur.Close(ctx)
+	}
+	return nil
+}
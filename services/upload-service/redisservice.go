@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 )
@@ -12,12 +14,39 @@ type ChunkMeta struct {
 	Start    int    `json:"start"`
 	End      int    `json:"end"`
 	No       int    `json:"no"`
+
+	// Codec is how the stored bytes are compressed ("" for raw, "gzip" or
+	// "zstd"). The stored length is End-Start+1; Size is the length once
+	// decoded, 0 for chunks packed before compression existed.
+	Codec string `json:"codec,omitempty"`
+	Size  int    `json:"size,omitempty"`
+
+	// KeyID names the key the stored bytes are encrypted with, "" when they
+	// are not encrypted
+	KeyID string `json:"key_id,omitempty"`
+
+	// Seen is the unix time the chunk was last packed or deduplicated
+	// against; GC never collects a chunk seen within its grace period
+	Seen int64 `json:"seen,omitempty"`
 }
 
 var ctx = context.Background()
 
-func CheckSHAExistence(rdb *redis.Client, shas []string) (existing []string, missing []string, err error) {
-	values, err := rdb.MGet(ctx, shas...).Result()
+// RedisChunkIndex stores each chunk as a JSON ChunkMeta under its SHA
+type RedisChunkIndex struct {
+	rdb *redis.Client
+}
+
+func NewRedisChunkIndex(rdb *redis.Client) *RedisChunkIndex {
+	return &RedisChunkIndex{rdb: rdb}
+}
+
+func (r *RedisChunkIndex) Exists(ctx context.Context, shas []string) (existing []string, missing []string, err error) {
+	if len(shas) == 0 {
+		return nil, nil, nil
+	}
+
+	values, err := r.rdb.MGet(ctx, shas...).Result()
 	if err != nil {
 		return nil, nil, err
 	}
@@ -33,11 +62,44 @@ func CheckSHAExistence(rdb *redis.Client, shas []string) (existing []string, mis
 	return existing, missing, nil
 }
 
-func StoreSHAMetadata(rdb *redis.Client, metaMap map[string]ChunkMeta) error {
+func (r *RedisChunkIndex) Get(ctx context.Context, shas []string) (map[string]ChunkMeta, error) {
+	result := make(map[string]ChunkMeta, len(shas))
+	if len(shas) == 0 {
+		return result, nil
+	}
+
+	values, err := r.rdb.MGet(ctx, shas...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("redis MGet failed: %v", err)
+	}
+
+	for i, val := range values {
+		if val == nil {
+			continue
+		}
+		strVal, ok := val.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid type for key %s", shas[i])
+		}
+
+		var meta ChunkMeta
+		if err := json.Unmarshal([]byte(strVal), &meta); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal value for key %s: %v", shas[i], err)
+		}
+		result[shas[i]] = meta
+	}
+
+	return result, nil
+}
+
+func (r *RedisChunkIndex) PutBatch(ctx context.Context, metas map[string]ChunkMeta) error {
+	if len(metas) == 0 {
+		return nil
+	}
 
-	kvPairs := make([]interface{}, 0, len(metaMap)*2)
+	kvPairs := make([]interface{}, 0, len(metas)*2)
 
-	for sha, meta := range metaMap {
+	for sha, meta := range metas {
 		jsonVal, err := json.Marshal(meta)
 		if err != nil {
 			return err
@@ -45,5 +107,163 @@ func StoreSHAMetadata(rdb *redis.Client, metaMap map[string]ChunkMeta) error {
 		kvPairs = append(kvPairs, sha, jsonVal)
 	}
 
-	return rdb.MSet(ctx, kvPairs...).Err()
+	return r.rdb.MSet(ctx, kvPairs...).Err()
+}
+
+// deleteUnseenScript deletes each key last seen at or before ARGV[1] and
+// returns the deleted keys and their values in turn. Checking seen in the
+// script keeps a Touch that lands after GC's scan from being lost.
+var deleteUnseenScript = redis.NewScript(`
+local cutoff = tonumber(ARGV[1])
+local deleted = {}
+for _, key in ipairs(KEYS) do
+	local cur = redis.call('GET', key)
+	if cur then
+		local meta = cjson.decode(cur)
+		if (tonumber(meta.seen) or 0) <= cutoff then
+			redis.call('DEL', key)
+			table.insert(deleted, key)
+			table.insert(deleted, cur)
+		end
+	end
+end
+return deleted
+`)
+
+func (r *RedisChunkIndex) DeleteUnseen(ctx context.Context, shas []string, cutoff int64) (map[string]ChunkMeta, error) {
+	deleted := make(map[string]ChunkMeta)
+	if len(shas) == 0 {
+		return deleted, nil
+	}
+
+	values, err := deleteUnseenScript.Run(ctx, r.rdb, shas, cutoff).StringSlice()
+	if err != nil {
+		return nil, fmt.Errorf("redis delete failed: %v", err)
+	}
+	for i := 0; i+1 < len(values); i += 2 {
+		var meta ChunkMeta
+		if err := json.Unmarshal([]byte(values[i+1]), &meta); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal value for key %s: %v", values[i], err)
+		}
+		deleted[values[i]] = meta
+	}
+	return deleted, nil
+}
+
+// touchScript sets seen on each key that exists and was last seen at least
+// ARGV[2] seconds before ARGV[1]. Only that field is changed, in place, so a
+// Repoint or Delete running at the same time is never undone by a stale copy
+// of the entry.
+var touchScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local touched = 0
+for _, key in ipairs(KEYS) do
+	local cur = redis.call('GET', key)
+	if cur then
+		local meta = cjson.decode(cur)
+		if now - (tonumber(meta.seen) or 0) >= interval then
+			meta.seen = now
+			redis.call('SET', key, cjson.encode(meta), 'KEEPTTL')
+			touched = touched + 1
+		end
+	end
+end
+return touched
+`)
+
+func (r *RedisChunkIndex) Touch(ctx context.Context, shas []string) error {
+	if len(shas) == 0 {
+		return nil
+	}
+	now := time.Now().Unix()
+	if err := touchScript.Run(ctx, r.rdb, shas, now, int64(touchInterval/time.Second)).Err(); err != nil {
+		return fmt.Errorf("redis touch failed: %v", err)
+	}
+	return nil
+}
+
+// repointScript moves each key only if it still points at ARGV[1], so entries
+// GC deleted or that were re-uploaded elsewhere are left alone
+var repointScript = redis.NewScript(`
+local moved = 0
+for i, key in ipairs(KEYS) do
+	local cur = redis.call('GET', key)
+	if cur then
+		local meta = cjson.decode(cur)
+		if meta.filename == ARGV[1] then
+			local to = cjson.decode(ARGV[i + 1])
+			meta.filename = to.filename
+			meta.start = to.start
+			meta['end'] = to['end']
+			meta.codec = to.codec
+			meta.size = to.size
+			meta.key_id = to.key_id
+			redis.call('SET', key, cjson.encode(meta), 'KEEPTTL')
+			moved = moved + 1
+		end
+	end
+end
+return moved
+`)
+
+func (r *RedisChunkIndex) Repoint(ctx context.Context, from string, moves map[string]ChunkMeta) (int, error) {
+	keys := make([]string, 0, len(moves))
+	args := []interface{}{from}
+	for sha, to := range moves {
+		jsonVal, err := json.Marshal(to)
+		if err != nil {
+			return 0, err
+		}
+		keys = append(keys, sha)
+		args = append(args, jsonVal)
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	moved, err := repointScript.Run(ctx, r.rdb, keys, args...).Int()
+	if err != nil {
+		return 0, fmt.Errorf("redis repoint failed: %v", err)
+	}
+	return moved, nil
+}
+
+// Iterate SCANs the keyspace and only visits keys that look like chunk keys,
+// since the same Redis may hold other data
+func (r *RedisChunkIndex) Iterate(ctx context.Context, fn func(sha string, meta ChunkMeta) error) error {
+	var cursor uint64
+
+	for {
+		keys, next, err := r.rdb.Scan(ctx, cursor, "*", 1000).Result()
+		if err != nil {
+			return fmt.Errorf("redis SCAN failed: %v", err)
+		}
+
+		var shas []string
+		for _, key := range keys {
+			if _, _, ok := splitChunkKey(key); ok {
+				shas = append(shas, key)
+			}
+		}
+
+		metas, err := r.Get(ctx, shas)
+		if err != nil {
+			return err
+		}
+		for _, sha := range shas {
+			meta, ok := metas[sha]
+			if !ok {
+				continue
+			}
+			if err := fn(sha, meta); err != nil {
+				return err
+			}
+		}
+
+		cursor = next
+		if cursor == 0 {
+			return nil
+		}
+	}
 }
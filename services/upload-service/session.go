@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SessionStore keeps the chunks of unfinished uploads on local disk so a
+// client whose websocket drops can reconnect, ask what already arrived and
+// carry on. Each session is a directory holding one file per chunk, named
+// <chunk_no>_<sha>.chunk, and an owner file naming the user who started it;
+// only that user can resume it.
+type SessionStore struct {
+	root string
+	ttl  time.Duration
+
+	lock   sync.Mutex
+	active map[string]bool
+}
+
+// UploadSession is a session currently attached to a websocket
+type UploadSession struct {
+	ID    string
+	dir   string
+	store *SessionStore
+}
+
+var Sessions *SessionStore
+
+const sessionOwnerFile = "owner"
+
+var ErrSessionNotFound = errors.New("upload session not found")
+var ErrSessionBusy = errors.New("upload session is in use by another connection")
+
+// InitSessionStore reads UPLOAD_SESSION_DIR and UPLOAD_SESSION_TTL and starts
+// the janitor that drops abandoned sessions
+func InitSessionStore() {
+	dir := os.Getenv("UPLOAD_SESSION_DIR")
+	if dir == "" {
+		dir = "upload-sessions"
+	}
+
+	ttl := 24 * time.Hour
+	if v := os.Getenv("UPLOAD_SESSION_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid UPLOAD_SESSION_TTL %q: %v", v, err)
+		}
+		ttl = d
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatalf("Failed to create upload session dir: %v", err)
+	}
+
+	Sessions = &SessionStore{root: dir, ttl: ttl, active: make(map[string]bool)}
+	Sessions.startJanitor()
+}
+
+func (s *SessionStore) attach(id string) (*UploadSession, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.active[id] {
+		return nil, ErrSessionBusy
+	}
+	s.active[id] = true
+	return &UploadSession{ID: id, dir: filepath.Join(s.root, id), store: s}, nil
+}
+
+// Create starts a new, empty session owned by a user
+func (s *SessionStore) Create(owner string) (*UploadSession, error) {
+	id := uuid.New().String()
+	dir := filepath.Join(s.root, id)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create session %s: %v", id, err)
+	}
+	if err := writeFileSync(filepath.Join(dir, sessionOwnerFile), []byte(owner)); err != nil {
+		return nil, fmt.Errorf("failed to create session %s: %v", id, err)
+	}
+	return s.attach(id)
+}
+
+// Resume reattaches to an existing session and returns the chunks it holds.
+// Sessions of other users are reported as not found.
+func (s *SessionStore) Resume(id, owner string) (*UploadSession, []Chunk, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, nil, ErrSessionNotFound
+	}
+	stored, err := os.ReadFile(filepath.Join(s.root, id, sessionOwnerFile))
+	if err != nil || string(stored) != owner {
+		return nil, nil, ErrSessionNotFound
+	}
+
+	session, err := s.attach(id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	chunks, err := session.load()
+	if err != nil {
+		session.Detach()
+		return nil, nil, err
+	}
+	return session, chunks, nil
+}
+
+func (u *UploadSession) load() ([]Chunk, error) {
+	entries, err := os.ReadDir(u.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read session %s: %v", u.ID, err)
+	}
+
+	var chunks []Chunk
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".chunk")
+		if !ok {
+			continue
+		}
+		no, sha, ok := strings.Cut(name, "_")
+		if !ok {
+			continue
+		}
+		chunkNo, err := strconv.Atoi(no)
+		if err != nil {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(u.dir, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read chunk %s of session %s: %v", sha, u.ID, err)
+		}
+		chunks = append(chunks, Chunk{ChunkNo: chunkNo, SHA: sha, Bytes: data})
+	}
+	return chunks, nil
+}
+
+// Save durably stores a verified chunk. Only once it returns may the chunk be
+// acknowledged to the client.
+func (u *UploadSession) Save(chunk Chunk) error {
+	name := fmt.Sprintf("%d_%s.chunk", chunk.ChunkNo, chunk.SHA)
+	return writeFileSync(filepath.Join(u.dir, name), chunk.Bytes)
+}
+
+// Detach releases the session so another connection can resume it
+func (u *UploadSession) Detach() {
+	u.store.lock.Lock()
+	defer u.store.lock.Unlock()
+	delete(u.store.active, u.ID)
+}
+
+// Finish removes a session whose chunks have been handed to the queue
+func (u *UploadSession) Finish() {
+	if err := os.RemoveAll(u.dir); err != nil {
+		log.Printf("Failed to remove upload session %s: %v", u.ID, err)
+	}
+	u.Detach()
+}
+
+func (s *SessionStore) startJanitor() {
+	go func() {
+		for {
+			time.Sleep(10 * time.Minute)
+			s.expire()
+		}
+	}()
+}
+
+// expire drops sessions nobody has written to for longer than the TTL
+func (s *SessionStore) expire() {
+	entries, err := os.ReadDir(s.root)
+	if err != nil {
+		log.Printf("[Sessions] Failed to list sessions: %v", err)
+		return
+	}
+
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < s.ttl {
+			continue
+		}
+
+		// Hold the session while deleting it so nobody resumes it halfway
+		session, err := s.attach(e.Name())
+		if err != nil {
+			continue
+		}
+		log.Printf("[Sessions] Expiring abandoned upload session %s", e.Name())
+		session.Finish()
+	}
+}
@@ -0,0 +1,2 @@
+/* Stand-in for the emscripten header so cdc.c builds natively */
+#define EMSCRIPTEN_KEEPALIVE
@@ -0,0 +1,100 @@
+/*
+ * Writes the test vectors for cdc_test.go by running chunk-wasm/cdc.c over
+ * the inputs described there. Build and run from this directory:
+ *
+ *   cc -I. -Wno-deprecated-declarations -o gencdc main.c ../../../../chunk-wasm/cdc.c ../../../../chunk-wasm/cJSON.c -lcrypto
+ *   ./gencdc > ../cdc_vectors.json
+ */
+#include <stdbool.h>
+#include <stdint.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+typedef struct {
+    size_t start;
+    size_t end;
+    size_t chunk_no;
+    char sha[65];
+} Block;
+
+void reset_chunking_state(void);
+void process_chunk(uint8_t *chunk, int len, bool isEnd);
+size_t get_block_count(void);
+Block get_block(int index);
+char *get_blocks_json(void);
+
+typedef struct {
+    const char *name;
+    const char *kind;
+    uint32_t seed;
+    size_t length;
+} Input;
+
+/* Keep in step with vectorInput in cdc_test.go */
+static const Input inputs[] = {
+    {"empty", "random", 1, 0},
+    {"one byte", "random", 1, 1},
+    {"below min chunk", "random", 2, 2047},
+    {"min chunk", "random", 3, 2048},
+    {"random 100k", "random", 4, 100000},
+    {"random 300k", "random", 5, 300000},
+    {"text", "text", 0, 40000},
+    {"zeros", "zeros", 0, 20000},
+};
+
+static uint8_t *make_input(const Input *in) {
+    static const char text[] = "the quick brown fox jumps over the lazy dog\n";
+    uint8_t *buf = malloc(in->length + 1);
+    uint32_t x = in->seed;
+    for (size_t i = 0; i < in->length; i++) {
+        if (strcmp(in->kind, "random") == 0) {
+            x ^= x << 13;
+            x ^= x >> 17;
+            x ^= x << 5;
+            buf[i] = (uint8_t)x;
+        } else if (strcmp(in->kind, "text") == 0) {
+            buf[i] = (uint8_t)text[i % (sizeof(text) - 1)];
+        } else {
+            buf[i] = 0;
+        }
+    }
+    return buf;
+}
+
+/* Chunks buf in writes of at most step bytes and returns the blocks as JSON */
+static char *chunk(uint8_t *buf, size_t len, size_t step) {
+    reset_chunking_state();
+    size_t off = 0;
+    do {
+        size_t n = len - off < step ? len - off : step;
+        process_chunk(buf + off, (int)n, off + n == len);
+        off += n;
+    } while (off < len);
+    return strdup(get_blocks_json());
+}
+
+int main(void) {
+    size_t steps[] = {1, 7, 4096, 16384};
+    printf("[\n");
+    for (size_t i = 0; i < sizeof(inputs) / sizeof(inputs[0]); i++) {
+        const Input *in = &inputs[i];
+        uint8_t *buf = make_input(in);
+        char *whole = chunk(buf, in->length, in->length + 1);
+        for (size_t s = 0; s < sizeof(steps) / sizeof(steps[0]); s++) {
+            char *split = chunk(buf, in->length, steps[s]);
+            if (strcmp(whole, split) != 0) {
+                fprintf(stderr, "%s: writes of %zu bytes chunk differently\n", in->name, steps[s]);
+                return 1;
+            }
+            free(split);
+        }
+        printf("  {\"name\": \"%s\", \"kind\": \"%s\", \"seed\": %u, \"length\": %zu,\n   \"blocks\": %s}%s\n",
+               in->name, in->kind, in->seed, in->length, whole,
+               i + 1 < sizeof(inputs) / sizeof(inputs[0]) ? "," : "");
+        free(whole);
+        free(buf);
+    }
+    printf("]\n");
+    return 0;
+}
@@ -0,0 +1,10 @@
+/* The part of libtomcrypt cdc.c uses, backed by OpenSSL */
+#include <openssl/sha.h>
+
+#define CRYPT_OK 0
+
+typedef SHA256_CTX hash_state;
+
+static int sha256_init(hash_state *md) { return SHA256_Init(md) == 1 ? CRYPT_OK : 1; }
+static int sha256_process(hash_state *md, const unsigned char *in, unsigned long len) { return SHA256_Update(md, in, len) == 1 ? CRYPT_OK : 1; }
+static int sha256_done(hash_state *md, unsigned char *out) { return SHA256_Final(out, md) == 1 ? CRYPT_OK : 1; }
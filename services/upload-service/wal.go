@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// IngestLog is the write-ahead log behind the ingest queue. Every batch is
+// written to its own segment file and fsynced before it is queued, and a
+// segment is only deleted once all of its chunks have been packed and their
+// metadata published. On startup the remaining segments are replayed.
+//
+// Segment layout:
+//
+//	"NSWAL2"
+//	repeated: chunk_no u32 | sha [32]byte | length u32 | data |
+//	          domain length u8 | domain
+//	crc32 (IEEE) of everything before it
+//
+// "NSWAL1" segments, written before dedup domains, have no domain fields and
+// are replayed into the global domain.
+// Segments are written through a temp file and renamed into place, so a crash
+// never leaves a half written one behind. A segment that fails its checksum is
+// renamed to .corrupt on replay and left for an operator.
+type IngestLog struct {
+	dir string
+
+	lock    sync.Mutex
+	nextSeq uint64
+	pending map[uint64]int // segment -> chunks not yet committed
+}
+
+const (
+	walMagic   = "NSWAL2"
+	walMagicV1 = "NSWAL1"
+)
+
+func OpenIngestLog(dir string) (*IngestLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create WAL dir %s: %v", dir, err)
+	}
+
+	l := &IngestLog{dir: dir, nextSeq: 1, pending: make(map[uint64]int)}
+
+	// Segments moved aside as corrupt keep their numbers, so a new segment
+	// that is damaged in turn never overwrites one left for an operator
+	for _, suffix := range []string{".wal", ".wal.corrupt"} {
+		seqs, err := l.segments(suffix)
+		if err != nil {
+			return nil, err
+		}
+		if len(seqs) > 0 {
+			l.nextSeq = max(l.nextSeq, seqs[len(seqs)-1]+1)
+		}
+	}
+	return l, nil
+}
+
+// segments lists the sequence numbers of the files with suffix on disk,
+// oldest first
+func (l *IngestLog) segments(suffix string) ([]uint64, error) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var seqs []uint64
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), suffix)
+		if !ok {
+			continue
+		}
+		seq, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+func (l *IngestLog) segmentPath(seq uint64) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%020d.wal", seq))
+}
+
+// Append durably writes a batch and tags each chunk with its segment
+func (l *IngestLog) Append(chunks []Chunk) error {
+	segment, err := encodeSegment(chunks)
+	if err != nil {
+		return err
+	}
+
+	l.lock.Lock()
+	seq := l.nextSeq
+	l.nextSeq++
+	l.lock.Unlock()
+
+	if err := writeFileSync(l.segmentPath(seq), segment); err != nil {
+		return fmt.Errorf("failed to write WAL segment %d: %v", seq, err)
+	}
+
+	l.lock.Lock()
+	l.pending[seq] += len(chunks)
+	l.lock.Unlock()
+
+	for i := range chunks {
+		chunks[i].segment = seq
+	}
+	return nil
+}
+
+// Release marks chunks as safely committed and deletes segments that have
+// nothing left in flight
+func (l *IngestLog) Release(chunks []Chunk) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for _, chunk := range chunks {
+		if chunk.segment == 0 {
+			continue
+		}
+		l.pending[chunk.segment]--
+		if l.pending[chunk.segment] > 0 {
+			continue
+		}
+		delete(l.pending, chunk.segment)
+		if err := os.Remove(l.segmentPath(chunk.segment)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("[WAL] Failed to remove segment %d: %v", chunk.segment, err)
+		}
+	}
+}
+
+// Replay loads every segment left over from a previous run, oldest first
+func (l *IngestLog) Replay() ([][]Chunk, error) {
+	seqs, err := l.segments(".wal")
+	if err != nil {
+		return nil, err
+	}
+
+	var batches [][]Chunk
+	for _, seq := range seqs {
+		path := l.segmentPath(seq)
+		chunks, err := readSegment(path)
+		if err != nil {
+			log.Printf("[WAL] Segment %d is unreadable, moving it aside: %v", seq, err)
+			os.Rename(path, path+".corrupt")
+			continue
+		}
+
+		if len(chunks) == 0 {
+			os.Remove(path)
+			continue
+		}
+		for i := range chunks {
+			chunks[i].segment = seq
+		}
+
+		l.lock.Lock()
+		l.pending[seq] = len(chunks)
+		l.lock.Unlock()
+
+		batches = append(batches, chunks)
+	}
+	return batches, nil
+}
+
+func encodeSegment(chunks []Chunk) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(walMagic)
+
+	for _, chunk := range chunks {
+		sha, err := hex.DecodeString(chunk.SHA)
+		if err != nil || len(sha) != 32 {
+			return nil, fmt.Errorf("invalid sha %q", chunk.SHA)
+		}
+		binary.Write(&buf, binary.BigEndian, uint32(chunk.ChunkNo))
+		buf.Write(sha)
+		binary.Write(&buf, binary.BigEndian, uint32(len(chunk.Bytes)))
+		buf.Write(chunk.Bytes)
+		if len(chunk.Domain) > 255 {
+			return nil, fmt.Errorf("domain %q is too long", chunk.Domain)
+		}
+		buf.WriteByte(byte(len(chunk.Domain)))
+		buf.WriteString(chunk.Domain)
+	}
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(buf.Bytes()))
+
+	return buf.Bytes(), nil
+}
+
+func readSegment(path string) ([]Chunk, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < len(walMagic)+4 {
+		return nil, errors.New("missing header")
+	}
+	magic := string(data[:len(walMagic)])
+	if magic != walMagic && magic != walMagicV1 {
+		return nil, errors.New("missing header")
+	}
+
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(data[len(data)-4:]) {
+		return nil, errors.New("checksum mismatch")
+	}
+
+	r := bufio.NewReader(bytes.NewReader(body[len(walMagic):]))
+	var chunks []Chunk
+	for {
+		var no uint32
+		if err := binary.Read(r, binary.BigEndian, &no); err == io.EOF {
+			return chunks, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		sha := make([]byte, 32)
+		var length uint32
+		if _, err := io.ReadFull(r, sha); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return nil, err
+		}
+		chunkData := make([]byte, length)
+		if _, err := io.ReadFull(r, chunkData); err != nil {
+			return nil, err
+		}
+
+		chunk := Chunk{ChunkNo: int(no), SHA: hex.EncodeToString(sha), Bytes: chunkData}
+		if magic == walMagic {
+			n, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			domain := make([]byte, n)
+			if _, err := io.ReadFull(r, domain); err != nil {
+				return nil, err
+			}
+			chunk.Domain = string(domain)
+		}
+		chunks = append(chunks, chunk)
+	}
+}
+
+// writeFileSync writes data to path through a temp file, fsyncing it before
+// the rename so the file is either complete or absent after a crash
+func writeFileSync(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
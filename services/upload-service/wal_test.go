@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testChunk(no int, data, domain string) Chunk {
+	sum := sha256.Sum256([]byte(data))
+	return Chunk{ChunkNo: no, SHA: hex.EncodeToString(sum[:]), Bytes: []byte(data), Domain: domain}
+}
+
+func sameChunks(t *testing.T, got, want []Chunk) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d chunks, want %d", len(got), len(want))
+	}
+	for i := range got {
+		g, w := got[i], want[i]
+		if g.ChunkNo != w.ChunkNo || g.SHA != w.SHA || !bytes.Equal(g.Bytes, w.Bytes) || g.Domain != w.Domain {
+			t.Errorf("chunk %d is %d %s %q %q, want %d %s %q %q", i, g.ChunkNo, g.SHA, g.Bytes, g.Domain, w.ChunkNo, w.SHA, w.Bytes, w.Domain)
+		}
+	}
+}
+
+func TestIngestLogReplay(t *testing.T) {
+	dir := t.TempDir()
+	l, err := OpenIngestLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batches := [][]Chunk{
+		{testChunk(1, "first", ""), testChunk(2, "second", "user:42")},
+		{testChunk(3, "", "org:acme")},
+		{testChunk(4, "fourth", "")},
+	}
+	for _, b := range batches {
+		if err := l.Append(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, c := range batches[0] {
+		if c.segment != 1 {
+			t.Errorf("chunk %d of the first batch is in segment %d", i, c.segment)
+		}
+	}
+
+	// Committing part of a segment keeps it; committing the rest removes it
+	l.Release(batches[0][:1])
+	l.Release(batches[2])
+	if _, err := os.Stat(l.segmentPath(1)); err != nil {
+		t.Errorf("partly committed segment is gone: %v", err)
+	}
+	if _, err := os.Stat(l.segmentPath(3)); !os.IsNotExist(err) {
+		t.Errorf("committed segment is still there: %v", err)
+	}
+
+	// A temp file left by a crash during Append is not a segment
+	os.WriteFile(filepath.Join(dir, ".tmp-123"), []byte("partial"), 0644)
+
+	l, err = OpenIngestLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed, err := l.Replay()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replayed) != 2 {
+		t.Fatalf("replayed %d batches, want 2", len(replayed))
+	}
+	sameChunks(t, replayed[0], batches[0])
+	sameChunks(t, replayed[1], batches[1])
+
+	// New segments continue after the replayed ones, and replayed chunks are
+	// released like appended ones
+	next := []Chunk{testChunk(5, "fifth", "")}
+	if err := l.Append(next); err != nil {
+		t.Fatal(err)
+	}
+	if next[0].segment != 3 {
+		t.Errorf("new segment is %d, want 3", next[0].segment)
+	}
+	l.Release(replayed[0])
+	if _, err := os.Stat(l.segmentPath(1)); !os.IsNotExist(err) {
+		t.Errorf("replayed segment was not removed once committed: %v", err)
+	}
+}
+
+func TestIngestLogDamagedSegments(t *testing.T) {
+	good, err := encodeSegment([]Chunk{testChunk(1, "some chunk data", "user:1"), testChunk(2, "more", "user:1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty, err := encodeSegment(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flipped := bytes.Clone(good)
+	flipped[len(walMagic)+10] ^= 1
+	badMagic := bytes.Clone(good)
+	copy(badMagic, "NSWAL9")
+
+	// A segment whose record claims more data than there is, with a valid
+	// checksum over what was written
+	overrun := append([]byte(walMagic), 0, 0, 0, 1)
+	overrun = append(overrun, make([]byte, 32)...)
+	overrun = binary.BigEndian.AppendUint32(overrun, 100)
+	overrun = append(overrun, "short"...)
+	overrun = binary.BigEndian.AppendUint32(overrun, crc32.ChecksumIEEE(overrun))
+
+	tests := []struct {
+		name    string
+		segment []byte
+		corrupt bool
+	}{
+		{"empty file", nil, true},
+		{"magic only", []byte(walMagic), true},
+		{"torn in header", good[:3], true},
+		{"torn in record", good[:len(walMagic)+20], true},
+		{"torn in checksum", good[:len(good)-2], true},
+		{"trailing garbage", append(bytes.Clone(good), 0), true},
+		{"flipped bit", flipped, true},
+		{"unknown magic", badMagic, true},
+		{"record overruns segment", overrun, true},
+		{"no chunks", empty, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			l, err := OpenIngestLog(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := l.Append([]Chunk{testChunk(1, "before", "")}); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(l.segmentPath(2), tt.segment, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if l, err = OpenIngestLog(dir); err != nil {
+				t.Fatal(err)
+			}
+			if err := l.Append([]Chunk{testChunk(1, "after", "")}); err != nil {
+				t.Fatal(err)
+			}
+
+			l, err = OpenIngestLog(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			batches, err := l.Replay()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(batches) != 2 || string(batches[0][0].Bytes) != "before" || string(batches[1][0].Bytes) != "after" {
+				t.Fatalf("segments around the damaged one were not replayed: %v", batches)
+			}
+
+			_, err = os.Stat(l.segmentPath(2) + ".corrupt")
+			if tt.corrupt && err != nil {
+				t.Errorf("damaged segment was not moved aside: %v", err)
+			}
+			if !tt.corrupt && !os.IsNotExist(err) {
+				t.Errorf("segment was moved aside: %v", err)
+			}
+			if _, err := os.Stat(l.segmentPath(2)); !os.IsNotExist(err) {
+				t.Errorf("segment was left in place: %v", err)
+			}
+		})
+	}
+}
+
+// A segment moved aside as corrupt keeps its number after a restart, even
+// once no live segment is left after it
+func TestIngestLogKeepsCorruptSegmentNumbers(t *testing.T) {
+	dir := t.TempDir()
+	l, err := OpenIngestLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := []Chunk{testChunk(1, "first", "")}
+	if err := l.Append(first); err != nil {
+		t.Fatal(err)
+	}
+	damaged := []byte("not a segment")
+	if err := os.WriteFile(l.segmentPath(2), damaged, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if l, err = OpenIngestLog(dir); err != nil {
+		t.Fatal(err)
+	}
+	replayed, err := l.Replay()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Release(replayed[0])
+
+	if l, err = OpenIngestLog(dir); err != nil {
+		t.Fatal(err)
+	}
+	next := []Chunk{testChunk(1, "next", "")}
+	if err := l.Append(next); err != nil {
+		t.Fatal(err)
+	}
+	if next[0].segment != 3 {
+		t.Errorf("new segment is %d, want 3", next[0].segment)
+	}
+	if data, err := os.ReadFile(l.segmentPath(2) + ".corrupt"); err != nil || !bytes.Equal(data, damaged) {
+		t.Errorf("corrupt segment was changed: %q, %v", data, err)
+	}
+}
+
+func TestIngestLogV1Segment(t *testing.T) {
+	chunk := testChunk(7, "written before dedup domains", "")
+	sha, _ := hex.DecodeString(chunk.SHA)
+
+	segment := []byte(walMagicV1)
+	segment = binary.BigEndian.AppendUint32(segment, uint32(chunk.ChunkNo))
+	segment = append(segment, sha...)
+	segment = binary.BigEndian.AppendUint32(segment, uint32(len(chunk.Bytes)))
+	segment = append(segment, chunk.Bytes...)
+	segment = binary.BigEndian.AppendUint32(segment, crc32.ChecksumIEEE(segment))
+
+	dir := t.TempDir()
+	l, err := OpenIngestLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(l.segmentPath(1), segment, 0644); err != nil {
+		t.Fatal(err)
+	}
+	batches, err := l.Replay()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batches) != 1 {
+		t.Fatalf("replayed %d batches, want 1", len(batches))
+	}
+	sameChunks(t, batches[0], []Chunk{chunk})
+}
+
+func TestEncodeSegmentRejects(t *testing.T) {
+	tests := []struct {
+		name  string
+		chunk Chunk
+	}{
+		{"sha not hex", Chunk{SHA: "not a sha"}},
+		{"short sha", Chunk{SHA: "abcd"}},
+		{"long domain", testChunk(1, "x", string(make([]byte, 256)))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := encodeSegment([]Chunk{tt.chunk}); err == nil {
+				t.Error("segment was encoded")
+			}
+		})
+	}
+}
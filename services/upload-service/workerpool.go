@@ -1,80 +1,120 @@
 package main
 
 import (
-	"encoding/base64"
 	"fmt"
-	"os"
 	"sync"
-
-	"github.com/google/uuid"
+	"time"
 )
 
 type Task struct {
 	Chunks [][]Chunk
 }
 
+// Process packs the task's chunks, one pack per dedup domain
 func (t *Task) Process() {
+	var domains []string
+	byDomain := make(map[string][]Chunk)
+	for _, chunkSlice := range t.Chunks {
+		for _, chunk := range chunkSlice {
+			if _, ok := byDomain[chunk.Domain]; !ok {
+				domains = append(domains, chunk.Domain)
+			}
+			byDomain[chunk.Domain] = append(byDomain[chunk.Domain], chunk)
+		}
+	}
+
+	for _, domain := range domains {
+		t.processDomain(domain, byDomain[domain])
+	}
+}
+
+func (t *Task) processDomain(domain string, allChunks []Chunk) {
 	totalChunks := 0
-	uid := uuid.New()
-	key := fmt.Sprintf("chunk_set_%s.bin", uid.String())
-	outputFile := key
+	key := newPackKey(domain)
+
+	var shas []string
+	for _, chunk := range allChunks {
+		shas = append(shas, chunk.SHA)
+	}
 
-	file, err := os.Create(outputFile)
+	// Chunks replayed from the WAL, or queued twice by concurrent uploads, may
+	// already be packed
+	var existing []string
+	err := retry("existence check", func() error {
+		var err error
+		existing, _, err = existsInDomain(domain, shas)
+		return err
+	})
 	if err != nil {
-		fmt.Printf("Failed to create file: %v\n", err)
+		t.deadLetter(allChunks, err)
 		return
 	}
-	defer file.Close()
+	skip := make(map[string]bool, len(existing))
+	for _, sha := range existing {
+		skip[sha] = true
+	}
+	touchChunks(domain, existing)
 
-	currentOffset := 0
+	pack := NewPackWriter()
+	seen := time.Now().Unix()
 	chunkMetaMap := make(map[string]ChunkMeta)
 
-	for i, chunkSlice := range t.Chunks {
-		for j, chunk := range chunkSlice {
-			data, err := base64.StdEncoding.DecodeString(chunk.Data)
-			if err != nil {
-				fmt.Printf("Failed to decode chunk (%d,%d): %v\n", i, j, err)
-				continue
-			}
+	for _, chunk := range allChunks {
+		if skip[chunk.SHA] {
+			continue
+		}
+		skip[chunk.SHA] = true
 
-			start := currentOffset
-			n, err := file.Write(data)
-			if err != nil {
-				fmt.Printf("Failed to write chunk (%d,%d): %v\n", i, j, err)
-				continue
-			}
-			end := currentOffset + n - 1
-			currentOffset += n
-			totalChunks++
-
-			chunkMetaMap[chunk.SHA] = ChunkMeta{
-				Filename: key,
-				Start:    start,
-				End:      end,
-				No:       chunk.ChunkNo,
-			}
+		stored, codec := compressChunk(chunk.Bytes)
+		stored, keyID, err := sealChunk(chunk.SHA, stored)
+		if err != nil {
+			t.deadLetter(allChunks, fmt.Errorf("failed to encrypt chunk %s: %v", chunk.SHA, err))
+			return
 		}
-	}
+		entry, err := pack.Add(PackEntry{
+			SHA:       chunk.SHA,
+			ChunkNo:   chunk.ChunkNo,
+			RawLength: uint32(len(chunk.Bytes)),
+			Codec:     codec,
+			KeyID:     keyID,
+		}, stored)
+		if err != nil {
+			t.deadLetter(allChunks, err)
+			return
+		}
+		totalChunks++
 
-	fmt.Printf("Processing completed: %d total chunks written to %s\n", totalChunks, outputFile)
+		meta := entry.Meta(key)
+		meta.Seen = seen
+		chunkMetaMap[chunkKey(domain, chunk.SHA)] = meta
+	}
 
-	for sha, meta := range chunkMetaMap {
-		fmt.Printf("SHA: %s -> %+v\n", sha, meta)
+	if totalChunks == 0 {
+		fmt.Println("Every chunk in the task was already packed")
+		globalQueue.Commit(allChunks)
+		return
 	}
 
-	err = UploadBinFileToS3(outputFile, key)
-	if err != nil {
-		fmt.Printf("Failed to upload to S3: %v\n", err)
-	} else {
-		fmt.Printf("File uploaded to S3 with key: %s\n", key)
+	fmt.Printf("Processing completed: %d total chunks written to %s\n", totalChunks, key)
+
+	if err := commitPack(key, pack.Finish(), chunkMetaMap); err != nil {
+		fmt.Printf("Failed to commit pack %s: %v\n", key, err)
+		t.deadLetter(allChunks, err)
+		return
 	}
+	fmt.Printf("Pack %s committed with metadata for %d chunks\n", key, totalChunks)
 
-	err = StoreSHAMetadata(RedisClient, chunkMetaMap)
-	if err != nil {
-		fmt.Printf("Failed to store metadata in Redis: %v\n", err)
-	} else {
-		fmt.Printf("Chunk metadata stored in Redis for %d chunks\n", totalChunks)
+	globalQueue.Commit(allChunks)
+}
+
+// deadLetter parks chunks that could not be committed. They only leave the
+// WAL once the dead letter is safely written.
+func (t *Task) deadLetter(chunks []Chunk, cause error) {
+	if err := DeadLetters.Add(chunks, cause); err != nil {
+		fmt.Printf("Failed to dead-letter task, leaving it in the WAL: %v\n", err)
+		return
 	}
+	globalQueue.Commit(chunks)
 }
 
 type WorkerPool struct {